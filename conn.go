@@ -5,15 +5,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/moby/spdystream"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/httpstream"
 )
 
 const networkName = "port-forward"
 
+var errUnreadData = errors.New("connection has unread data")
+
 type fwdAddr string
 
 func (f fwdAddr) Network() string {
@@ -27,73 +35,474 @@ func (f fwdAddr) String() string {
 // FwdConn implements net.Conn, but it also adds some convenience methods for
 // common operations like http.Client.
 type FwdConn struct {
-	fwd       httpstream.Connection
+	fw        *Forwarder
+	sc        *sharedConn
 	data, err httpstream.Stream
-	errch     chan error
 	port      string
 	pod       v1.Pod
+
+	// reads carries chunks from readLoop to Read. rbuf and rerr hold what a
+	// previous Read did not consume and are guarded by rmu.
+	reads chan readResult
+	rmu   sync.Mutex
+	rbuf  []byte
+	rerr  error
+
+	// wpending holds a write that outlived its deadline and is guarded by wmu.
+	wmu      sync.Mutex
+	wpending chan writeResult
+
+	rd, wd deadline
+
+	// rclosed is closed by CloseRead. wclosed is set by CloseWrite and
+	// guarded by wmu.
+	rclosed       chan struct{}
+	closeReadOnce sync.Once
+	wclosed       bool
+
+	// span covers the lifetime of the connection. It is a no-op span unless
+	// the Forwarder was created WithConnSpans.
+	span            trace.Span
+	nread, nwritten atomic.Int64
+
+	// log carries the namespace, pod, port and request ID of the connection.
+	log    *slog.Logger
+	opened time.Time
+
+	// onClose, if set, is called once the connection has been closed.
+	onClose func()
+
+	// ferr is the error reported on the error stream. It must only be read
+	// once failed is closed.
+	failed   chan struct{}
+	failOnce sync.Once
+	ferr     error
+
+	// cause is why the connection was closed, if not by Close. It must only
+	// be read once closed is closed.
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	cause     error
+
+	// done is closed once failed or closed is.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// drained is closed once readLoop has seen the data stream end.
+	drained chan struct{}
+}
+
+// closeLinger is how long Close waits for the pod to close its side of the
+// data stream.
+const closeLinger = time.Second
+
+// readBufSize is the size of the chunks read from the data stream.
+const readBufSize = 32 * 1024
+
+type readResult struct {
+	b   []byte
+	err error
 }
 
+type writeResult struct {
+	n   int
+	err error
+}
+
+func newFwdConn(fw *Forwarder, sc *sharedConn, pod v1.Pod, port string, data, errStream httpstream.Stream) *FwdConn {
+	return &FwdConn{
+		fw:      fw,
+		sc:      sc,
+		port:    port,
+		err:     errStream,
+		data:    data,
+		pod:     pod,
+		reads:   make(chan readResult),
+		rd:      makeDeadline(),
+		wd:      makeDeadline(),
+		rclosed: make(chan struct{}),
+		failed:  make(chan struct{}),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+		drained: make(chan struct{}),
+		span:    trace.SpanFromContext(context.Background()),
+		log:     fw.log.With("namespace", pod.Namespace, "pod", pod.Name, "port", port),
+		opened:  time.Now(),
+	}
+}
+
+// watchErr reads the error stream until the kubelet closes it, failing the
+// connection if it reports an error or the stream breaks.
 func (f *FwdConn) watchErr(ctx context.Context) {
-	// This should only return if an err comes back
 	bs, err := io.ReadAll(f.err)
-	if err != nil {
-		select {
-		case <-ctx.Done():
-		case f.errch <- fmt.Errorf("error while reading error stream: %w", err):
+	switch {
+	case len(bs) > 0:
+		fe := streamError(f.pod.Namespace, f.pod.Name, f.port, string(bs))
+		f.fw.metrics.StreamError(f.pod.Namespace, f.pod.Name, f.port, fe.Kind)
+		f.span.RecordError(fe)
+		f.log.WarnContext(ctx, "kubelet reported error", "kind", fe.Kind.String(), "message", fe.Message)
+		f.fail(fe)
+	case err != nil && !isClosedChan(f.closed):
+		fe := &ForwardError{
+			Kind:      StreamReset,
+			Namespace: f.pod.Namespace,
+			Pod:       f.pod.Name,
+			Port:      f.port,
+			Err:       fmt.Errorf("error while reading error stream: %w", err),
 		}
+		f.fw.metrics.StreamError(f.pod.Namespace, f.pod.Name, f.port, StreamReset)
+		f.span.RecordError(fe)
+		f.log.WarnContext(ctx, "error stream broke", "err", err)
+		f.fail(fe)
 	}
-	if len(bs) > 0 {
-		select {
-		case <-ctx.Done():
-		case f.errch <- fmt.Errorf("error returned from apiserver: %s", string(bs)):
+}
+
+// fail latches err as the connection's error. Pending and later calls return
+// it, and the data stream is reset so that writes in flight give up.
+func (f *FwdConn) fail(err error) {
+	f.failOnce.Do(func() {
+		f.ferr = err
+		close(f.failed)
+		f.doneOnce.Do(func() { close(f.done) })
+		if !isClosedChan(f.closed) {
+			f.data.Reset()
 		}
+	})
+}
+
+// watchConn fails the connection once the shared connection it was created on
+// goes away, as its streams then end without the kubelet saying why.
+func (f *FwdConn) watchConn() {
+	select {
+	case <-f.sc.conn.CloseChan():
+	case <-f.closed:
+		return
+	}
+	if !isClosedChan(f.closed) {
+		f.fail(&ForwardError{Kind: StreamReset, Namespace: f.pod.Namespace, Pod: f.pod.Name, Port: f.port,
+			Message: "connection to the apiserver closed"})
 	}
 }
 
-// Read first checks if there is an error on the error stream. If there is, it
-// returns it. Otherwise, it reads from the data stream.
-func (f *FwdConn) Read(b []byte) (n int, err error) {
+// Done returns a channel that is closed once the kubelet reports an error on
+// the connection, the connection to the apiserver is lost or it is closed.
+func (f *FwdConn) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns nil while Done is not closed. Afterwards it returns the error
+// the kubelet reported, as a *ForwardError, or, if there was none, an error
+// matching net.ErrClosed.
+func (f *FwdConn) Err() error {
 	select {
-	case err := <-f.errch:
-		return 0, err
+	case <-f.failed:
+		return f.ferr
 	default:
 	}
-	return f.data.Read(b)
+	select {
+	case <-f.closed:
+		return f.closedErr()
+	default:
+		return nil
+	}
+}
+
+// readLoop reads from the data stream on behalf of Read, so that a Read can
+// give up on its deadline without losing data that arrives afterwards. After
+// CloseRead, and once the connection is done, it keeps draining the stream
+// until it ends, so that unread data does not hold up other streams on the
+// shared connection.
+func (f *FwdConn) readLoop() {
+	defer close(f.drained)
+	for {
+		buf := make([]byte, readBufSize)
+		n, err := f.data.Read(buf)
+		select {
+		case f.reads <- readResult{b: buf[:n], err: err}:
+		case <-f.rclosed:
+		case <-f.done:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads from the data stream until data arrives, the read deadline
+// passes, the kubelet reports an error or the connection is closed. Once the
+// kubelet has reported an error, it is returned by every Read.
+func (f *FwdConn) Read(b []byte) (n int, err error) {
+	f.rmu.Lock()
+	defer f.rmu.Unlock()
+
+	switch {
+	case isClosedChan(f.done):
+		return 0, f.Err()
+	case isClosedChan(f.rclosed):
+		return 0, io.EOF
+	case isClosedChan(f.rd.wait()):
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if len(f.rbuf) == 0 && f.rerr == nil {
+		select {
+		case res := <-f.reads:
+			f.rbuf, f.rerr = res.b, res.err
+		case <-f.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-f.rclosed:
+			return 0, io.EOF
+		case <-f.done:
+			return 0, f.Err()
+		}
+	}
+
+	n = copy(b, f.rbuf)
+	f.rbuf = f.rbuf[n:]
+	if n > 0 {
+		f.nread.Add(int64(n))
+		f.fw.metrics.BytesRead(f.pod.Namespace, f.pod.Name, f.port, n)
+	}
+	if len(f.rbuf) == 0 && f.rerr != nil {
+		return n, f.streamErr(f.rerr)
+	}
+	return n, nil
 }
 
-// Write first checks if there is an error on the error stream. If there is, it
-// returns it. Otherwise, it writes to the data stream.
+// Write writes to the data stream. The write is abandoned once the write
+// deadline passes, even if it was set after the write started; the connection
+// should be treated as broken afterwards, as with any net.Conn. Once the
+// kubelet has reported an error, writes in flight are aborted and every Write
+// returns it.
+//
+// To be abandonable, every write is made by a goroutine from a copy of b, so
+// each Write costs an allocation and a goroutine on top of the stream's own
+// work. Callers writing many small buffers should batch them, e.g. with a
+// bufio.Writer.
 func (f *FwdConn) Write(b []byte) (n int, err error) {
+	defer func() {
+		if n > 0 {
+			f.nwritten.Add(int64(n))
+			f.fw.metrics.BytesWritten(f.pod.Namespace, f.pod.Name, f.port, n)
+		}
+	}()
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	switch {
+	case isClosedChan(f.done):
+		return 0, f.Err()
+	case f.wclosed:
+		return 0, io.ErrClosedPipe
+	case isClosedChan(f.wd.wait()):
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	// Writes must not be reordered, so wait out one that timed out earlier.
+	if f.wpending != nil {
+		select {
+		case res := <-f.wpending:
+			f.wpending = nil
+			if res.err != nil {
+				return 0, f.streamErr(res.err)
+			}
+		case <-f.wd.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-f.done:
+			return 0, f.Err()
+		}
+	}
+
+	// A deadline may be set while the write is in progress, so the write is
+	// always made in the background. It may outlive this call, so it must not
+	// use the caller's buffer.
+	buf := append([]byte(nil), b...)
+	ch := make(chan writeResult, 1)
+	go func() {
+		n, err := f.data.Write(buf)
+		ch <- writeResult{n: n, err: err}
+	}()
+
 	select {
-	case err := <-f.errch:
-		return 0, err
-	default:
+	case res := <-ch:
+		return res.n, f.streamErr(res.err)
+	case <-f.wd.wait():
+		f.wpending = ch
+		return 0, os.ErrDeadlineExceeded
+	case <-f.done:
+		return 0, f.Err()
+	}
+}
+
+// streamErr replaces an error from the data stream with the connection's
+// error if it failed or was closed, as that is what broke the stream.
+func (f *FwdConn) streamErr(err error) error {
+	if err != nil && isClosedChan(f.done) {
+		return f.Err()
+	}
+	return err
+}
+
+// CloseWrite shuts down the writing side of the connection, so that the pod
+// reads EOF, while data it sends can still be read. Later writes fail with
+// io.ErrClosedPipe. It waits for a write abandoned at its deadline to finish
+// first, so that the pod sees everything that was written, unless the write
+// deadline has passed again.
+func (f *FwdConn) CloseWrite() error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	if err := f.Err(); err != nil {
+		return err
+	}
+	if f.wclosed {
+		return nil
+	}
+
+	if f.wpending != nil {
+		select {
+		case <-f.wpending:
+			f.wpending = nil
+		case <-f.wd.wait():
+			return os.ErrDeadlineExceeded
+		case <-f.done:
+			return f.Err()
+		}
+	}
+	f.wclosed = true
+	return f.data.Close()
+}
+
+// CloseRead shuts down the reading side of the connection. Pending and later
+// reads return io.EOF, and data the pod sends from then on is discarded.
+func (f *FwdConn) CloseRead() error {
+	if err := f.Err(); err != nil {
+		return err
 	}
-	return f.data.Write(b)
+	f.closeReadOnce.Do(func() {
+		close(f.rclosed)
+	})
+	return nil
 }
 
-// Close closes the connection, removing the streams and closing the forwarder.
-// It returns an error if any of the operations fail.
+// Close closes the connection, closing its streams and releasing the shared
+// connection to the pod, which is closed if no other FwdConn is using it.
+// Everything written is delivered: Close half-closes the connection and waits
+// up to a second for the pod to close its side, discarding what it still
+// sends. It returns the error the kubelet reported, if any, joined with those
+// of any operations that fail. Subsequent calls return the same result.
 func (f *FwdConn) Close() error {
-	var errs []error
-	select {
-	case err := <-f.errch:
+	return f.closeWithCause(nil)
+}
+
+// closeWithCause closes the connection, making operations that find it closed
+// report cause along with net.ErrClosed.
+func (f *FwdConn) closeWithCause(cause error) error {
+	f.closeOnce.Do(func() {
+		f.cause = cause
+		close(f.closed)
+		f.doneOnce.Do(func() { close(f.done) })
+
+		var errs []error
+		if isClosedChan(f.failed) {
+			errs = append(errs, f.ferr)
+		}
+		// Other connections may still be using the shared connection, so our
+		// streams are closed rather than the connection. Unless the connection
+		// is being aborted, the data stream is half-closed and the pod given
+		// time to close its side, as closing the shared connection before it
+		// has read everything would lose what is still in flight. Resetting a
+		// stream whose writing side is closed sends nothing and only stops
+		// local reads.
+		if cause == nil && !isClosedChan(f.failed) {
+			err := f.data.Close()
+			if err != nil && !errors.Is(err, spdystream.ErrWriteClosedStream) {
+				errs = append(errs, err)
+			}
+			select {
+			case <-f.drained:
+			case <-time.After(closeLinger):
+			}
+		}
+		f.data.Reset()
+		f.err.Reset()
+		f.sc.conn.RemoveStreams(f.data, f.err)
+		err := f.fw.release(f.sc)
 		if err != nil {
 			errs = append(errs, err)
 		}
+		f.closeErr = errors.Join(errs...)
+		f.fw.metrics.ForwardClosed(f.pod.Namespace, f.pod.Name, f.port)
+		f.endConnSpan(errors.Join(cause, f.closeErr))
+		f.log.Debug("connection closed", "duration", time.Since(f.opened),
+			"bytes_read", f.nread.Load(), "bytes_written", f.nwritten.Load(), "cause", cause, "err", f.closeErr)
+		if f.onClose != nil {
+			f.onClose()
+		}
+	})
+	return f.closeErr
+}
+
+// closedErr returns the error for operations on the closed connection.
+func (f *FwdConn) closedErr() error {
+	if f.cause != nil {
+		return fmt.Errorf("%w: %w", net.ErrClosed, f.cause)
+	}
+	return net.ErrClosed
+}
+
+// bindContext closes the connection once ctx ends.
+func (f *FwdConn) bindContext(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		f.closeWithCause(context.Cause(ctx))
+	})
+	go func() {
+		<-f.closed
+		stop()
+	}()
+}
+
+// idleErr reports why a connection that is not being used can no longer be
+// reused, or nil if it can. A connection can only be reused if it is open in
+// both directions and nothing has arrived on it.
+func (f *FwdConn) idleErr() error {
+	if err := f.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case <-f.sc.conn.CloseChan():
+		return &ForwardError{Kind: StreamReset, Namespace: f.pod.Namespace, Pod: f.pod.Name, Port: f.port,
+			Message: "connection to the apiserver closed"}
 	default:
 	}
-	err := f.data.Close()
-	if err != nil {
-		errs = append(errs, err)
+	if isClosedChan(f.rclosed) {
+		return io.EOF
+	}
+
+	f.wmu.Lock()
+	wclosed := f.wclosed || f.wpending != nil
+	f.wmu.Unlock()
+	if wclosed {
+		return io.ErrClosedPipe
+	}
+
+	f.rmu.Lock()
+	defer f.rmu.Unlock()
+	if len(f.rbuf) == 0 && f.rerr == nil {
+		select {
+		case res := <-f.reads:
+			f.rbuf, f.rerr = res.b, res.err
+		default:
+			return nil
+		}
 	}
-	f.fwd.RemoveStreams(f.data, f.err)
-	err = f.fwd.Close()
-	if err != nil {
-		errs = append(errs, err)
+	if f.rerr != nil {
+		return f.rerr
 	}
-	return errors.Join(errs...)
+	return errUnreadData
 }
 
 // LocalAddr returns the local network address, if known.
@@ -105,17 +514,22 @@ func (f *FwdConn) RemoteAddr() net.Addr {
 	return fwdAddr(fmt.Sprintf("k8s/%s/%s:%s", f.pod.Namespace, f.pod.Name, f.port))
 }
 
+// SetDeadline sets both the read and write deadlines. Pending Read and Write
+// calls return os.ErrDeadlineExceeded once it passes. The zero time clears it.
 func (f *FwdConn) SetDeadline(t time.Time) error {
-	f.fwd.SetIdleTimeout(time.Until(t))
+	f.rd.set(t)
+	f.wd.set(t)
 	return nil
 }
 
+// SetReadDeadline sets the deadline for pending and future Read calls.
 func (f *FwdConn) SetReadDeadline(t time.Time) error {
-	f.fwd.SetIdleTimeout(time.Until(t))
+	f.rd.set(t)
 	return nil
 }
 
+// SetWriteDeadline sets the deadline for pending and future Write calls.
 func (f *FwdConn) SetWriteDeadline(t time.Time) error {
-	f.fwd.SetIdleTimeout(time.Until(t))
+	f.wd.set(t)
 	return nil
 }
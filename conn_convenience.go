@@ -7,7 +7,9 @@ import (
 )
 
 // HTTPTransport returns an http.Transport that uses the FwdConn as the
-// underlying connection. Note: it will always reuse the same conn
+// underlying connection. Note: it will always reuse the same conn, so it is
+// only suitable for sequential requests to a single server. Forwarder's
+// HTTPTransport dials a new connection whenever the transport needs one.
 func (f *FwdConn) HTTPTransport() *http.Transport {
 	return &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
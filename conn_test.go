@@ -0,0 +1,172 @@
+package k8sport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// newTestForwarder returns a Forwarder that is not connected to any cluster.
+func newTestForwarder(t *testing.T, opts ...Option) *Forwarder {
+	t.Helper()
+	opts = append([]Option{WithRESTClient(&rest.RESTClient{}), WithRoundTripper(http.DefaultTransport, nil)}, opts...)
+	fw, err := NewForwarder(nil, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	return fw
+}
+
+func newPipeFwdConn(t *testing.T) (*FwdConn, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	errLocal, errRemote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+		errLocal.Close()
+		errRemote.Close()
+	})
+
+	fc := newFwdConn(newTestForwarder(t), nil, corev1.Pod{}, "80", pipeStream{local}, pipeStream{errLocal})
+	go fc.readLoop()
+	return fc, remote
+}
+
+func TestFwdConnReadDeadline(t *testing.T) {
+	fc, remote := newPipeFwdConn(t)
+
+	fc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := fc.Read(make([]byte, 1))
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	// Data that arrives after the deadline must not be lost once it is cleared.
+	go remote.Write([]byte("hello"))
+	fc.SetReadDeadline(time.Time{})
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(fc, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected hello, got %q (%v)", buf, err)
+	}
+}
+
+func TestFwdConnWriteDeadline(t *testing.T) {
+	fc, remote := newPipeFwdConn(t)
+
+	// Nothing reads from the remote end, so the write blocks until the deadline.
+	fc.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := fc.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if _, err := fc.Write([]byte("again")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected expired deadline to stick, got %v", err)
+	}
+
+	// Extending the deadline lets the abandoned write complete in order.
+	fc.SetWriteDeadline(time.Now().Add(time.Second))
+	go io.Copy(io.Discard, remote)
+	if _, err := fc.Write([]byte("world")); err != nil {
+		t.Fatalf("expected write to succeed, got %v", err)
+	}
+}
+
+func TestFwdConnLateWriteDeadline(t *testing.T) {
+	fc, remote := newPipeFwdConn(t)
+
+	// The write starts without a deadline, so only a later one can end it.
+	time.AfterFunc(20*time.Millisecond, func() {
+		fc.SetWriteDeadline(time.Now())
+	})
+	if _, err := fc.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a deadline set during the write to abandon it, got %v", err)
+	}
+	if err := fc.CloseWrite(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected CloseWrite to give up on the abandoned write, got %v", err)
+	}
+
+	fc.SetWriteDeadline(time.Time{})
+	got := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(remote)
+		got <- string(b)
+	}()
+	if err := fc.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	if b := <-got; b != "hello" {
+		t.Errorf("Expected the abandoned write to complete before EOF, got %q", b)
+	}
+}
+
+func TestFwdConnHalfClose(t *testing.T) {
+	fc, remote := newPipeFwdConn(t)
+
+	if err := fc.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected remote to read EOF, got %v", err)
+	}
+	if _, err := fc.Write([]byte("late")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected io.ErrClosedPipe, got %v", err)
+	}
+
+	fc.CloseRead()
+	if _, err := fc.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF after CloseRead, got %v", err)
+	}
+}
+
+func TestFwdConnLogging(t *testing.T) {
+	var buf bytes.Buffer
+	fw := newTestForwarder(t, WithLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	local, remote := net.Pipe()
+	errLocal, errRemote := net.Pipe()
+	defer remote.Close()
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+	fc := newFwdConn(fw, newStubSharedConn(pod), pod, "80", pipeStream{local}, pipeStream{errLocal})
+	fc.log = fc.log.With("request_id", 7)
+	go fc.watchErr(context.Background())
+	go fc.readLoop()
+
+	go remote.Write([]byte("hi"))
+	if _, err := io.ReadFull(fc, make([]byte, 2)); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	go func() {
+		errRemote.Write([]byte("an error occurred forwarding 80 -> 80: connection refused"))
+		errRemote.Close()
+	}()
+	var ferr *ForwardError
+	if _, err := fc.Read(make([]byte, 1)); !errors.As(err, &ferr) {
+		t.Errorf("Expected the kubelet error, got %v", err)
+	}
+	fc.Close()
+
+	out := buf.String()
+	for _, want := range []string{
+		`level=WARN msg="kubelet reported error" namespace=ns pod=mypod port=80 request_id=7 kind="port refused"`,
+		`level=DEBUG msg="connection closed" namespace=ns pod=mypod port=80 request_id=7 duration=`,
+		`bytes_read=2 bytes_written=0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected log to contain %q, got:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	ErrUnsupportedAddress = fmt.Errorf("unsupported address")
+	ErrUnsupportedNetwork = fmt.Errorf("unsupported network")
+)
+
+// DefaultClusterDomain is the cluster domain assumed for Kubernetes DNS names
+// when a Dialer does not set one.
+const DefaultClusterDomain = "cluster.local"
+
+// kindAliases maps the resource names accepted in addresses to target kinds,
+// mostly following kubectl's short names.
+var kindAliases = map[string]TargetKind{
+	"pod":          KindPod,
+	"pods":         KindPod,
+	"po":           KindPod,
+	"svc":          KindService,
+	"service":      KindService,
+	"services":     KindService,
+	"deployment":   KindDeployment,
+	"deployments":  KindDeployment,
+	"deploy":       KindDeployment,
+	"statefulset":  KindStatefulSet,
+	"statefulsets": KindStatefulSet,
+	"sts":          KindStatefulSet,
+	"replicaset":   KindReplicaSet,
+	"replicasets":  KindReplicaSet,
+	"rs":           KindReplicaSet,
+	"daemonset":    KindDaemonSet,
+	"daemonsets":   KindDaemonSet,
+	"ds":           KindDaemonSet,
+	"selector":     KindSelector,
+}
+
+// Dialer dials addresses that name pods, services and workloads through a
+// Forwarder, so that it can be used anywhere a net.Dialer-style DialContext is
+// accepted. The zero value of every field other than Forwarder is usable.
+//
+// Addresses take the form kind/namespace/name:port, such as
+// pod/default/mypod:8080, svc/default/web:http or deploy/default/api:9000,
+// where the namespace may be omitted to use the Forwarder's default one. For
+// selector/namespace/app=foo:port the name is a label selector. Kubernetes
+// DNS names are understood too: name.namespace.svc[.cluster-domain]:port dials
+// a service, and host.subdomain.namespace.svc[.cluster-domain]:port dials the
+// pod named host, as for StatefulSet pods behind a headless service. As
+// slashes cannot appear in URL hosts, name.namespace.kind.cluster-domain:port,
+// such as mypod.default.pod.cluster.local:8080, is accepted for every other
+// kind as well; unlike with svc, the cluster domain is required, so that hosts
+// outside the cluster, such as api.example.rs, are left alone.
+type Dialer struct {
+	Forwarder *Forwarder
+
+	// ClusterDomain is the domain Kubernetes DNS names may end in. It defaults
+	// to DefaultClusterDomain.
+	ClusterDomain string
+
+	// Fallback, if set, dials addresses that are neither of the forms above,
+	// for example with a net.Dialer to reach hosts outside the cluster.
+	// Otherwise such addresses fail with ErrUnsupportedAddress.
+	Fallback func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialContext dials addr through a port forward using the default Dialer
+// settings. The returned net.Conn is a *FwdConn. See Dialer for the accepted
+// address forms.
+func (fw *Forwarder) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := Dialer{Forwarder: fw}
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialContext resolves addr to a target and forwards a connection to it. Only
+// TCP networks are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedNetwork, network)
+	}
+
+	t, port, err := d.ParseAddr(addr)
+	if err != nil {
+		if d.Fallback != nil && errors.Is(err, ErrUnsupportedAddress) {
+			return d.Fallback(ctx, network, addr)
+		}
+		return nil, err
+	}
+
+	conn, err := d.Forwarder.ForwardTarget(ctx, t, port)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: fwdAddr(addr), Err: err}
+	}
+	return conn, nil
+}
+
+// ParseAddr returns the target and port named by addr.
+func (d *Dialer) ParseAddr(addr string) (Target, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Target{}, "", fmt.Errorf("%w: %w", ErrUnsupportedAddress, err)
+	}
+
+	if strings.Contains(host, "/") {
+		t, err := d.parseTargetPath(host)
+		return t, port, err
+	}
+
+	t, ok := d.parseHostName(host)
+	if !ok {
+		return Target{}, "", fmt.Errorf("%w: %q", ErrUnsupportedAddress, addr)
+	}
+	return t, port, nil
+}
+
+// parseTargetPath parses kind/namespace/name or kind/name. Selectors may
+// themselves contain slashes, as in app.kubernetes.io/name=foo.
+func (d *Dialer) parseTargetPath(host string) (Target, error) {
+	parts := strings.SplitN(host, "/", 3)
+	if len(parts) == 2 {
+		namespace := DefaultNamespace
+		if d.Forwarder != nil {
+			namespace = d.Forwarder.namespace
+		}
+		parts = []string{parts[0], namespace, parts[1]}
+	}
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return Target{}, fmt.Errorf("%w: %q is not kind/namespace/name", ErrUnsupportedAddress, host)
+	}
+
+	kind, ok := kindAliases[strings.ToLower(parts[0])]
+	if !ok {
+		return Target{}, fmt.Errorf("%w: unknown kind %q", ErrUnsupportedAddress, parts[0])
+	}
+
+	t := Target{Kind: kind, Namespace: parts[1]}
+	if kind == KindSelector {
+		t.Selector = parts[2]
+	} else {
+		t.Name = parts[2]
+	}
+	return t, nil
+}
+
+// parseHostName parses Kubernetes DNS names, and the
+// name.namespace.kind.cluster-domain form that generalizes the service one to
+// every kind. Only the svc form may leave out the cluster domain, so that
+// names like api.example.rs are not mistaken for targets.
+func (d *Dialer) parseHostName(host string) (Target, bool) {
+	domain := d.ClusterDomain
+	if domain == "" {
+		domain = DefaultClusterDomain
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	host, inCluster := strings.CutSuffix(host, "."+strings.ToLower(domain))
+
+	labels := strings.Split(host, ".")
+	switch {
+	case len(labels) == 3:
+		kind, ok := kindAliases[labels[2]]
+		if !ok || kind == KindSelector || (labels[2] != "svc" && !inCluster) {
+			return Target{}, false
+		}
+		return Target{Kind: kind, Namespace: labels[1], Name: labels[0]}, true
+	case len(labels) == 4 && labels[3] == "svc":
+		return Target{Kind: KindPod, Namespace: labels[2], Name: labels[0]}, true
+	}
+	return Target{}, false
+}
@@ -0,0 +1,79 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDialerParseAddr(t *testing.T) {
+	testCases := []struct {
+		addr     string
+		domain   string
+		want     Target
+		wantPort string
+		wantErr  bool
+	}{
+		{addr: "pod/ns/mypod:8080", want: Target{Kind: KindPod, Namespace: "ns", Name: "mypod"}, wantPort: "8080"},
+		{addr: "svc/web:http", want: Target{Kind: KindService, Namespace: "default", Name: "web"}, wantPort: "http"},
+		{addr: "deploy/ns/api:9000", want: Target{Kind: KindDeployment, Namespace: "ns", Name: "api"}, wantPort: "9000"},
+		{addr: "sts/ns/db:5432", want: Target{Kind: KindStatefulSet, Namespace: "ns", Name: "db"}, wantPort: "5432"},
+		{
+			addr:     "selector/ns/app.kubernetes.io/name=foo:80",
+			want:     Target{Kind: KindSelector, Namespace: "ns", Selector: "app.kubernetes.io/name=foo"},
+			wantPort: "80",
+		},
+		{addr: "web.ns.svc.cluster.local:80", want: Target{Kind: KindService, Namespace: "ns", Name: "web"}, wantPort: "80"},
+		{addr: "web.ns.svc:80", want: Target{Kind: KindService, Namespace: "ns", Name: "web"}, wantPort: "80"},
+		{addr: "db-0.db.ns.svc.cluster.local.:5432", want: Target{Kind: KindPod, Namespace: "ns", Name: "db-0"}, wantPort: "5432"},
+		{addr: "web.ns.svc.corp.example:80", domain: "corp.example", want: Target{Kind: KindService, Namespace: "ns", Name: "web"}, wantPort: "80"},
+		{addr: "web.ns.svc.corp.example:80", wantErr: true},
+		{addr: "mypod.ns.pod.cluster.local:8080", want: Target{Kind: KindPod, Namespace: "ns", Name: "mypod"}, wantPort: "8080"},
+		{addr: "api.ns.deploy.cluster.local:9000", want: Target{Kind: KindDeployment, Namespace: "ns", Name: "api"}, wantPort: "9000"},
+		{addr: "mypod.ns.pod:8080", wantErr: true},
+		{addr: "api.example.rs:443", wantErr: true},
+		{addr: "www.example.services:443", wantErr: true},
+		{addr: "example.com:443", wantErr: true},
+		{addr: "cronjob/ns/x:80", wantErr: true},
+		{addr: "pod/ns/mypod", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			d := Dialer{ClusterDomain: tc.domain}
+			got, port, err := d.ParseAddr(tc.addr)
+			if tc.wantErr {
+				if !errors.Is(err, ErrUnsupportedAddress) {
+					t.Fatalf("Expected ErrUnsupportedAddress, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got.String() != tc.want.String() || got.Kind != tc.want.Kind || port != tc.wantPort {
+				t.Errorf("Expected %s port %s, got %s port %s", tc.want, tc.wantPort, got, port)
+			}
+		})
+	}
+}
+
+func TestDialerFallback(t *testing.T) {
+	called := false
+	d := Dialer{
+		Fallback: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			called = true
+			return nil, nil
+		},
+	}
+	for _, addr := range []string{"example.com:443", "api.example.rs:443"} {
+		called = false
+		if _, err := d.DialContext(context.Background(), "tcp", addr); err != nil || !called {
+			t.Errorf("Expected fallback to be used for %s, got called=%v err=%v", addr, called, err)
+		}
+	}
+	if _, err := d.DialContext(context.Background(), "udp", "web.ns.svc:53"); !errors.Is(err, ErrUnsupportedNetwork) {
+		t.Errorf("Expected ErrUnsupportedNetwork, got %v", err)
+	}
+}
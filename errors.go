@@ -0,0 +1,252 @@
+package k8sport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ErrorKind classifies why a port forward failed.
+type ErrorKind int
+
+const (
+	// Unknown covers failures that could not be classified.
+	Unknown ErrorKind = iota
+	// PodNotFound means the pod does not exist, or its sandbox is gone.
+	PodNotFound
+	// PodNotRunning means the pod exists but cannot be forwarded to yet or
+	// any more, e.g. it is unscheduled, pending or has terminated.
+	PodNotRunning
+	// PortRefused means nothing in the pod accepted the connection on the
+	// port.
+	PortRefused
+	// Forbidden means the credentials were rejected or are not allowed to
+	// create pods/portforward.
+	Forbidden
+	// Unavailable means the apiserver was overloaded or unreachable, such as
+	// a 429, a 5xx or a connection reset during the upgrade.
+	Unavailable
+	// UpgradeFailed means the connection could not be upgraded for another
+	// reason, e.g. a proxy in between that does not support it, an untrusted
+	// certificate or an apiserver name that does not resolve.
+	UpgradeFailed
+	// StreamReset means the upgraded connection or one of its streams broke
+	// down.
+	StreamReset
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case PodNotFound:
+		return "pod not found"
+	case PodNotRunning:
+		return "pod not running"
+	case PortRefused:
+		return "port refused"
+	case Forbidden:
+		return "forbidden"
+	case Unavailable:
+		return "apiserver unavailable"
+	case UpgradeFailed:
+		return "upgrade failed"
+	case StreamReset:
+		return "stream reset"
+	default:
+		return "unknown error"
+	}
+}
+
+// Retryable reports whether trying the same forward again may succeed.
+func (k ErrorKind) Retryable() bool {
+	switch k {
+	case PortRefused, Unavailable, StreamReset:
+		return true
+	default:
+		return false
+	}
+}
+
+// ForwardError describes a failed port forward. It is returned when dialing
+// the apiserver or creating streams fails, and from Read, Write and Close when
+// the kubelet reports an error on the error stream.
+//
+// Errors can be matched by kind with errors.Is against the ErrPodNotFound,
+// ErrPortRefused, etc. values, or inspected with errors.As.
+type ForwardError struct {
+	Kind      ErrorKind
+	Namespace string
+	Pod       string
+	Port      string
+
+	// StatusCode is the HTTP status of a failed upgrade, if there was one.
+	StatusCode int
+	// RetryAfter is how long the apiserver asked clients to wait before
+	// retrying, if it did.
+	RetryAfter time.Duration
+	// Message is the reason given by the apiserver or kubelet, if any.
+	Message string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+var (
+	ErrPodNotFound   = &ForwardError{Kind: PodNotFound}
+	ErrPodNotRunning = &ForwardError{Kind: PodNotRunning}
+	ErrPortRefused   = &ForwardError{Kind: PortRefused}
+	ErrForbidden     = &ForwardError{Kind: Forbidden}
+	ErrUnavailable   = &ForwardError{Kind: Unavailable}
+	ErrUpgradeFailed = &ForwardError{Kind: UpgradeFailed}
+	ErrStreamReset   = &ForwardError{Kind: StreamReset}
+)
+
+func (e *ForwardError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Kind.String())
+	if e.Pod != "" {
+		fmt.Fprintf(&b, ": pod %s/%s", e.Namespace, e.Pod)
+		if e.Port != "" {
+			fmt.Fprintf(&b, " port %s", e.Port)
+		}
+	}
+	switch {
+	case e.Message != "":
+		b.WriteString(": " + e.Message)
+	case e.Err != nil:
+		b.WriteString(": " + e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches any *ForwardError of the same kind, so that errors.Is can be
+// used with the ErrPodNotFound, ErrPortRefused, etc. values.
+func (e *ForwardError) Is(target error) bool {
+	t, ok := target.(*ForwardError)
+	return ok && t.Kind == e.Kind
+}
+
+// Retryable reports whether trying the same forward again may succeed.
+func (e *ForwardError) Retryable() bool {
+	return e.Kind.Retryable()
+}
+
+// IsRetryable reports whether err is a *ForwardError that may go away when the
+// forward is tried again.
+func IsRetryable(err error) bool {
+	var fe *ForwardError
+	return errors.As(err, &fe) && fe.Retryable()
+}
+
+// dialError classifies an error returned while upgrading the connection.
+func dialError(ns, pod, port string, err error) *ForwardError {
+	fe := &ForwardError{Namespace: ns, Pod: pod, Port: port, Err: err, Kind: UpgradeFailed}
+
+	var ue *upgradeError
+	if errors.As(err, &ue) {
+		fe.RetryAfter = ue.retryAfter
+	}
+
+	var status *apierrors.StatusError
+	if !errors.As(err, &status) {
+		msg := err.Error()
+		switch {
+		case misconfigured(msg):
+			// Retrying does not help when the apiserver's certificate is not
+			// trusted, its name does not resolve or the proxy is set up wrong.
+			fe.Kind = UpgradeFailed
+		case strings.Contains(msg, "error sending request"):
+			// The request never got a response, so the apiserver or the
+			// network in between is to blame.
+			fe.Kind = Unavailable
+		case strings.Contains(msg, "unable to upgrade connection"):
+			fe.Kind = classifyMessage(msg, UpgradeFailed)
+		}
+		return fe
+	}
+
+	fe.StatusCode = int(status.ErrStatus.Code)
+	fe.Message = status.ErrStatus.Message
+	if secs, ok := apierrors.SuggestsClientDelay(err); ok && fe.RetryAfter == 0 {
+		fe.RetryAfter = time.Duration(secs) * time.Second
+	}
+	switch {
+	case apierrors.IsNotFound(err):
+		fe.Kind = PodNotFound
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		fe.Kind = Forbidden
+	case apierrors.IsTooManyRequests(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err),
+		apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err),
+		fe.StatusCode >= http.StatusInternalServerError:
+		fe.Kind = Unavailable
+	default:
+		// Pods without a node or in a terminal phase are rejected with a bad
+		// request that only the message tells apart.
+		fe.Kind = classifyMessage(fe.Message, UpgradeFailed)
+	}
+	return fe
+}
+
+// misconfiguredMessages are parts of the messages of errors that the client's
+// configuration causes before a request reaches the apiserver. The upgrade
+// flattens them into strings.
+var misconfiguredMessages = []string{
+	"x509:",
+	"tls:",
+	"certificate",
+	"no such host",
+	"proxy url scheme not supported",
+	"unknown scheme",
+	"proxy authentication required",
+}
+
+// misconfigured reports whether msg is that of an error the client's
+// configuration caused.
+func misconfigured(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, m := range misconfiguredMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamError classifies a message received on the error stream.
+func streamError(ns, pod, port, msg string) *ForwardError {
+	return &ForwardError{
+		Kind:      classifyMessage(msg, Unknown),
+		Namespace: ns,
+		Pod:       pod,
+		Port:      port,
+		Message:   msg,
+	}
+}
+
+// classifyMessage recognizes the messages the apiserver and the kubelets of
+// the common container runtimes use for pod and port failures.
+func classifyMessage(msg string, fallback ErrorKind) ErrorKind {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, "connection refused"):
+		return PortRefused
+	case strings.Contains(msg, "does not have a host assigned"),
+		strings.Contains(msg, "not running"),
+		strings.Contains(msg, "cannot port forward into a container in a completed pod"),
+		strings.Contains(msg, "is terminated"):
+		return PodNotRunning
+	case strings.Contains(msg, "failed to find sandbox"),
+		strings.Contains(msg, "pod not found"),
+		strings.Contains(msg, "not found"):
+		return PodNotFound
+	case strings.Contains(msg, "forbidden"), strings.Contains(msg, "unauthorized"):
+		return Forbidden
+	}
+	return fallback
+}
@@ -0,0 +1,103 @@
+package k8sport
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDialErrorKinds(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+
+	testCases := []struct {
+		name string
+		err  error
+		want *ForwardError
+	}{
+		{name: "not found", err: apierrors.NewNotFound(pods, "mypod"), want: ErrPodNotFound},
+		{name: "forbidden", err: apierrors.NewForbidden(pods, "mypod", errors.New("no")), want: ErrForbidden},
+		{name: "unauthorized", err: apierrors.NewUnauthorized("who are you"), want: ErrForbidden},
+		{name: "throttled", err: apierrors.NewTooManyRequests("slow down", 1), want: ErrUnavailable},
+		{name: "server error", err: apierrors.NewInternalError(errors.New("boom")), want: ErrUnavailable},
+		{
+			name: "unscheduled",
+			err:  apierrors.NewBadRequest("pod mypod does not have a host assigned"),
+			want: ErrPodNotRunning,
+		},
+		{
+			name: "completed",
+			err:  apierrors.NewBadRequest("cannot port forward into a container in a completed pod; current phase is Succeeded"),
+			want: ErrPodNotRunning,
+		},
+		{name: "no response", err: fmt.Errorf("error sending request: %w", errors.New("connection reset by peer")), want: ErrUnavailable},
+		{name: "bad proxy", err: errors.New("unable to upgrade connection: 400 Bad Request"), want: ErrUpgradeFailed},
+		{
+			name: "untrusted certificate",
+			err:  errors.New(`error sending request: Post "https://apiserver:6443/api/v1/namespaces/ns/pods/mypod/portforward": tls: failed to verify certificate: x509: certificate signed by unknown authority`),
+			want: ErrUpgradeFailed,
+		},
+		{
+			name: "certificate name mismatch",
+			err:  errors.New(`error sending request: Post "https://apiserver:6443/api/v1/namespaces/ns/pods/mypod/portforward": x509: certificate is valid for kubernetes, not apiserver`),
+			want: ErrUpgradeFailed,
+		},
+		{
+			name: "unresolved host",
+			err:  errors.New(`error sending request: Post "https://apiserver:6443/api/v1/namespaces/ns/pods/mypod/portforward": dial tcp: lookup apiserver on 127.0.0.53:53: no such host`),
+			want: ErrUpgradeFailed,
+		},
+		{
+			name: "unsupported proxy",
+			err:  errors.New(`error sending request: Post "https://apiserver:6443/api/v1/namespaces/ns/pods/mypod/portforward": proxy URL scheme not supported: ftp`),
+			want: ErrUpgradeFailed,
+		},
+		{
+			name: "proxy credentials",
+			err:  errors.New(`error sending request: Post "https://apiserver:6443/api/v1/namespaces/ns/pods/mypod/portforward": CONNECT request to http://proxy:3128 returned response: 407 Proxy Authentication Required`),
+			want: ErrUpgradeFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := error(dialError("ns", "mypod", "80", fmt.Errorf("error dialing for stream: %w", tc.err)))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Expected kind %s, got %v", tc.want.Kind, err)
+			}
+			if IsRetryable(err) != tc.want.Retryable() {
+				t.Errorf("Expected retryable %v for %v", tc.want.Retryable(), err)
+			}
+		})
+	}
+}
+
+func TestStreamErrorKinds(t *testing.T) {
+	testCases := []struct {
+		msg  string
+		want *ForwardError
+	}{
+		{
+			msg:  `error forwarding port 80 to pod 1234, uid : failed to execute portforward in network namespace "/var/run/netns/cni-1": failed to connect to localhost:80 inside namespace "1234", IPv4: dial tcp4 127.0.0.1:80: connect: connection refused IPv6 dial tcp6 [::1]:80: connect: connection refused `,
+			want: ErrPortRefused,
+		},
+		{
+			msg:  `error forwarding port 80 to pod 1234, uid : failed to find sandbox "1234" in store: not found`,
+			want: ErrPodNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		err := streamError("ns", "mypod", "80", tc.msg)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("Expected kind %s, got %s for %q", tc.want.Kind, err.Kind, tc.msg)
+		}
+	}
+
+	var fe *ForwardError
+	if err := error(streamError("ns", "mypod", "80", "something odd")); !errors.As(err, &fe) || fe.Kind != Unknown {
+		t.Errorf("Expected unknown kind, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+)
+
+// PortForwarder forwards connections to pods. It is implemented by *Forwarder
+// and, without a cluster, by *FakeForwarder, so that code taking a
+// PortForwarder can be unit tested.
+type PortForwarder interface {
+	Forward(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error)
+	ForwardContainer(ctx context.Context, pod corev1.Pod, container, port string) (*FwdConn, error)
+	ForwardService(ctx context.Context, namespace, name, port string) (*FwdConn, error)
+	ForwardTarget(ctx context.Context, t Target, port string) (*FwdConn, error)
+	ResolveTarget(ctx context.Context, t Target, port string) (corev1.Pod, string, error)
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+var (
+	_ PortForwarder = (*Forwarder)(nil)
+	_ PortForwarder = (*FakeForwarder)(nil)
+)
+
+// FakeForwarder is an in-memory PortForwarder. Every forwarded connection is a
+// net.Pipe whose other end is handed to the handler registered for the pod and
+// port. As with a real pod, forwarding to a port without a handler succeeds,
+// and the kubelet's "connection refused" error is returned by the first Read
+// or Write that sees it. Forwarding to a pod without any handler fails with a
+// PodNotFound ForwardError. Pipes cannot be half-closed, so CloseWrite on a
+// FwdConn from a FakeForwarder closes both directions.
+type FakeForwarder struct {
+	fw *Forwarder
+
+	mu       sync.Mutex
+	pods     map[string]bool
+	handlers map[string]func(net.Conn)
+	targets  map[string]string
+}
+
+// NewFakeForwarder returns a FakeForwarder without handlers. Pods and targets
+// without a namespace are looked for in DefaultNamespace, unless a
+// WithNamespace option says otherwise. Options that configure the connection
+// to the apiserver, such as WithClientset, WithUpgradeProtocol and WithProxy,
+// are ignored.
+func NewFakeForwarder(opts ...Option) *FakeForwarder {
+	opts = append(opts, WithRESTClient(&rest.RESTClient{}), WithRoundTripper(http.DefaultTransport, nil), ignoreAPIServerOptions)
+	fw, err := NewForwarder(nil, opts...)
+	if err != nil {
+		// Unreachable, as nothing that needs a rest.Config is left to set up.
+		panic(err)
+	}
+	return &FakeForwarder{
+		fw:       fw,
+		pods:     map[string]bool{},
+		handlers: map[string]func(net.Conn){},
+		targets:  map[string]string{},
+	}
+}
+
+// ignoreAPIServerOptions undoes the options that configure how the apiserver is
+// reached, which a FakeForwarder never does and which need a rest.Config.
+func ignoreAPIServerOptions(fw *Forwarder) {
+	fw.upgrade = UpgradeSPDY
+	fw.proxyURL = nil
+	fw.proxyDial = nil
+	fw.optErr = nil
+}
+
+// Handle serves connections forwarded to the port of the pod with h, which is
+// given the pod's end of the connection and should return once it is done
+// with it. The pod's end is closed after h returns.
+func (f *FakeForwarder) Handle(namespace, pod, port string, h func(net.Conn)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pods[namespace+"/"+pod] = true
+	f.handlers[namespace+"/"+pod+":"+port] = h
+}
+
+// AddTarget makes the service, workload or selector target resolve to the
+// named pod in the target's namespace. Ports are passed on unchanged.
+func (f *FakeForwarder) AddTarget(t Target, pod string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.Namespace == "" {
+		t.Namespace = f.fw.namespace
+	}
+	f.targets[t.String()] = pod
+}
+
+// Forward connects to the handler for the pod and port.
+func (f *FakeForwarder) Forward(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error) {
+	return f.ForwardContainer(ctx, pod, "", port)
+}
+
+// ForwardContainer is like Forward. Named ports are resolved against the
+// containers in the pod's spec, which must be filled in.
+func (f *FakeForwarder) ForwardContainer(ctx context.Context, pod corev1.Pod, container, port string) (*FwdConn, error) {
+	f.fw.defaultNamespace(&pod)
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil && len(pod.Spec.Containers) == 0 {
+		return nil, &PortNotFoundError{Namespace: pod.Namespace, Pod: pod.Name, Container: container, Port: port}
+	}
+	resolved, err := f.fw.resolvePort(ctx, &pod, container, port)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	known := f.pods[pod.Namespace+"/"+pod.Name]
+	h := f.handlers[pod.Namespace+"/"+pod.Name+":"+resolved]
+	f.mu.Unlock()
+	if !known {
+		return nil, &ForwardError{Kind: PodNotFound, Namespace: pod.Namespace, Pod: pod.Name, Port: resolved,
+			Message: fmt.Sprintf("pods %q not found", pod.Name)}
+	}
+
+	local, remote := net.Pipe()
+	errLocal, errRemote := net.Pipe()
+	sc := &sharedConn{key: podKey(pod), conn: newPipeConnection(), refs: 1, ready: make(chan struct{})}
+	close(sc.ready)
+
+	fc := newFwdConn(f.fw, sc, pod, resolved, pipeStream{local}, pipeStream{errLocal})
+	fc.onClose = connOptsFrom(ctx).onClose
+	go fc.watchErr(ctx)
+	go fc.readLoop()
+
+	go func() {
+		// Like the kubelet, close the error stream before the data stream.
+		defer remote.Close()
+		defer errRemote.Close()
+		if h == nil {
+			fmt.Fprintf(errRemote, "an error occurred forwarding %s -> %s: error forwarding port %s to pod %s: "+
+				"dial tcp4 127.0.0.1:%s: connect: connection refused", resolved, resolved, resolved, pod.Name, resolved)
+			return
+		}
+		h(remote)
+	}()
+
+	f.fw.metrics.ForwardOpened(pod.Namespace, pod.Name, resolved)
+	if f.fw.bindsContext(ctx) {
+		fc.bindContext(ctx)
+	}
+	return fc, nil
+}
+
+// ForwardService forwards to the pod added for the service with AddTarget.
+func (f *FakeForwarder) ForwardService(ctx context.Context, namespace, name, port string) (*FwdConn, error) {
+	return f.ForwardTarget(ctx, Target{Kind: KindService, Namespace: namespace, Name: name}, port)
+}
+
+// ForwardTarget forwards to the pod the target resolves to.
+func (f *FakeForwarder) ForwardTarget(ctx context.Context, t Target, port string) (*FwdConn, error) {
+	pod, podPort, err := f.ResolveTarget(ctx, t, port)
+	if err != nil {
+		return nil, err
+	}
+	return f.Forward(ctx, pod, podPort)
+}
+
+// ResolveTarget returns the pod named by a KindPod target, or the one added
+// for any other target with AddTarget. Other targets have no ready pods.
+func (f *FakeForwarder) ResolveTarget(ctx context.Context, t Target, port string) (corev1.Pod, string, error) {
+	if t.Namespace == "" {
+		t.Namespace = f.fw.namespace
+	}
+	name := t.Name
+	if t.Kind != KindPod {
+		f.mu.Lock()
+		pod, ok := f.targets[t.String()]
+		f.mu.Unlock()
+		if !ok {
+			return corev1.Pod{}, "", fmt.Errorf("%w for %s", ErrNoReadyPods, t)
+		}
+		name = pod
+	}
+	return corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: t.Namespace, Name: name}}, port, nil
+}
+
+// DialContext forwards to the target addr names. See Dialer for the accepted
+// address forms.
+func (f *FakeForwarder) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedNetwork, network)
+	}
+
+	d := Dialer{Forwarder: f.fw}
+	t, port, err := d.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := f.ForwardTarget(ctx, t, port)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: fwdAddr(addr), Err: err}
+	}
+	return conn, nil
+}
+
+// pipeStream adapts one end of a net.Pipe to httpstream.Stream.
+type pipeStream struct {
+	net.Conn
+}
+
+func (p pipeStream) Reset() error         { return p.Conn.Close() }
+func (p pipeStream) Headers() http.Header { return http.Header{} }
+func (p pipeStream) Identifier() uint32   { return 0 }
+
+// pipeConnection stands in for the upgraded connection of FwdConns over
+// pipes, which have no connection to share.
+type pipeConnection struct {
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newPipeConnection() *pipeConnection {
+	return &pipeConnection{closed: make(chan bool)}
+}
+
+func (c *pipeConnection) CreateStream(http.Header) (httpstream.Stream, error) {
+	return nil, net.ErrClosed
+}
+
+func (c *pipeConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *pipeConnection) CloseChan() <-chan bool             { return c.closed }
+func (c *pipeConnection) SetIdleTimeout(time.Duration)       {}
+func (c *pipeConnection) RemoveStreams(...httpstream.Stream) {}
@@ -0,0 +1,523 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func newFakeServer(t *testing.T) (*k8sporttest.Server, *Forwarder) {
+	t.Helper()
+	srv := k8sporttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	fw, err := NewForwarder(srv.Config(), WithNamespace("ns"))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	return srv, fw
+}
+
+func TestForwardFakeServer(t *testing.T) {
+	srv, fw := newFakeServer(t)
+	srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mypod"}}
+
+	conns := make([]*FwdConn, 2)
+	for i := range conns {
+		fc, err := fw.Forward(ctx, pod, "80")
+		if err != nil {
+			t.Fatalf("Failed to forward: %v", err)
+		}
+		defer fc.Close()
+		conns[i] = fc
+	}
+	if n := srv.Upgrades(); n != 1 {
+		t.Errorf("Expected both forwards to share one connection, got %d upgrades", n)
+	}
+
+	for _, fc := range conns {
+		if _, err := fc.Write([]byte("hello")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if err := fc.CloseWrite(); err != nil {
+			t.Fatalf("Failed to close writing side: %v", err)
+		}
+		b, err := io.ReadAll(fc)
+		if err != nil || string(b) != "hello" {
+			t.Errorf("Expected echo of hello, got %q (%v)", b, err)
+		}
+	}
+}
+
+func TestForwardSharedConnRefs(t *testing.T) {
+	srv, fw := newFakeServer(t)
+	received := make(chan string, 4)
+	srv.Handle("ns", "mypod", "80", func(c *k8sporttest.Conn) {
+		b, _ := io.ReadAll(c)
+		received <- string(b)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+
+	fc1, err := fw.Forward(ctx, pod, "80")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	fc2, err := fw.Forward(ctx, pod, "80")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	if n := fw.ActiveConns(pod); n != 2 {
+		t.Errorf("Expected 2 active conns, got %d", n)
+	}
+
+	// Data written right before Close must reach the pod.
+	for i, fc := range []*FwdConn{fc1, fc2} {
+		if _, err := fc.Write([]byte("hello")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if err := fc.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+		select {
+		case got := <-received:
+			if got != "hello" {
+				t.Errorf("Expected the pod to read hello, got %q", got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Expected the pod to see EOF after Close")
+		}
+		if n := fw.ActiveConns(pod); n != 1-i {
+			t.Errorf("Expected %d active conns after closing %d, got %d", 1-i, i+1, n)
+		}
+	}
+
+	fw.connsMu.Lock()
+	left := len(fw.conns)
+	fw.connsMu.Unlock()
+	if left != 0 {
+		t.Errorf("Expected the shared connection to be forgotten after the last Close, %d left", left)
+	}
+
+	fc3, err := fw.Forward(ctx, pod, "80")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc3.Close()
+	if n := srv.Upgrades(); n != 2 {
+		t.Errorf("Expected a new upgrade once the shared connection was released, got %d upgrades", n)
+	}
+}
+
+func TestForwardFakeServerErrors(t *testing.T) {
+	srv, fw := newFakeServer(t)
+	srv.AddPod(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}},
+		},
+	})
+	srv.Handle("ns", "mypod", "8080", func(c *k8sporttest.Conn) {
+		c.Fail("an error occurred forwarding 8080 -> 8080: connection reset by peer")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var fe *ForwardError
+	_, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "gone"}}, "80")
+	if !errors.As(err, &fe) || fe.Kind != PodNotFound {
+		t.Errorf("Expected PodNotFound, got %v", err)
+	}
+
+	fc, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mypod"}}, "http")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc.Close()
+	if fc.port != "8080" {
+		t.Errorf("Expected named port to resolve to 8080, got %s", fc.port)
+	}
+	// The handler returning closes the data stream too, which may be seen
+	// before the error.
+	<-fc.Done()
+	if !errors.As(fc.Err(), &fe) || !strings.Contains(fe.Message, "connection reset by peer") {
+		t.Errorf("Expected the injected message, got %v", fc.Err())
+	}
+
+	fc2, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mypod"}}, "9090")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc2.Close()
+	<-fc2.Done()
+	if !errors.As(fc2.Err(), &fe) || fe.Kind != PortRefused {
+		t.Errorf("Expected PortRefused for a port without handler, got %v", fc2.Err())
+	}
+}
+
+func TestForwardContextCancellation(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	fw, err := NewForwarder(&rest.Config{Host: hung.URL})
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}, "80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the dial to end with the context, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected the dial to be abandoned promptly, took %v", d)
+	}
+}
+
+func TestForwardContextBoundConns(t *testing.T) {
+	srv := k8sporttest.NewServer()
+	defer srv.Close()
+	srv.Handle("ns", "mypod", "80", func(c *k8sporttest.Conn) {
+		io.Copy(io.Discard, c)
+	})
+	fw, err := NewForwarder(srv.Config(), WithContextBoundConns())
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fc, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}, "80")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fc.Read(make([]byte, 1))
+		errc <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) || !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the pending Read to fail with net.ErrClosed and context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected cancelling the context to unblock Read")
+	}
+	if _, err := fc.Write([]byte("late")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected later writes to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestForwardSharedDialContexts(t *testing.T) {
+	srv := k8sporttest.NewServer()
+	defer srv.Close()
+	srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+
+	// Hold upgrades until gate is closed, reporting each one that starts and
+	// each one that is abandoned.
+	var gate chan struct{}
+	entered := make(chan struct{}, 4)
+	aborted := make(chan struct{}, 4)
+	rc := srv.Config()
+	rc.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method == http.MethodPost {
+				entered <- struct{}{}
+				select {
+				case <-gate:
+				case <-req.Context().Done():
+					aborted <- struct{}{}
+					return nil, req.Context().Err()
+				}
+			}
+			return rt.RoundTrip(req)
+		})
+	}
+	fw, err := NewForwarder(rc)
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+
+	forward := func(ctx context.Context) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			fc, err := fw.Forward(ctx, pod, "80")
+			if err == nil {
+				fc.Close()
+			}
+			errc <- err
+		}()
+		return errc
+	}
+	waitActive := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); fw.ActiveConns(pod) != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d forwards waiting on the dial, got %d", n, fw.ActiveConns(pod))
+			}
+		}
+	}
+
+	// The caller that started the dial giving up must not fail the others.
+	gate = make(chan struct{})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	errc1 := forward(ctx1)
+	<-entered
+	errc2 := forward(context.Background())
+	waitActive(2)
+	cancel1()
+	if err := <-errc1; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled forward to fail with context.Canceled, got %v", err)
+	}
+	close(gate)
+	if err := <-errc2; err != nil {
+		t.Errorf("Expected the other forward to succeed, got %v", err)
+	}
+	if n := srv.Upgrades(); n != 1 {
+		t.Errorf("Expected one upgrade, got %d", n)
+	}
+
+	// Once every caller has given up, the dial is abandoned.
+	gate = make(chan struct{})
+	defer close(gate)
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	errc3 := forward(ctx3)
+	<-entered
+	cancel3()
+	if err := <-errc3; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled forward to fail with context.Canceled, got %v", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the dial to be abandoned once no forward waits for it")
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestContextBoundConnsExemptions(t *testing.T) {
+	srv := k8sporttest.NewServer()
+	defer srv.Close()
+	srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+	fw, err := NewForwarder(srv.Config(), WithContextBoundConns())
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	echo := func(c net.Conn) error {
+		if _, err := c.Write([]byte("hi")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(c, make([]byte, 2))
+		return err
+	}
+
+	p := fw.NewPool(PoolConfig{})
+	defer p.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	fc, err := p.Get(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}, "80")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	cancel()
+	if err := echo(fc); err != nil {
+		t.Errorf("Expected a pooled connection to outlive the context of Get, got %v", err)
+	}
+	p.Put(fc)
+
+	l, err := fw.NewListener("pod/ns/mypod:80", 1)
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer c.Close()
+	l.Close()
+	if err := echo(c); err != nil {
+		t.Errorf("Expected an accepted connection to outlive the listener, got %v", err)
+	}
+}
+
+func TestForwardListener(t *testing.T) {
+	srv, fw := newFakeServer(t)
+	srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+
+	if _, err := fw.NewListener("pod/ns/mypod:80", 0); err == nil {
+		t.Errorf("Expected a listener without a connection limit to be rejected")
+	}
+	l, err := fw.NewListener("pod/ns/mypod:80", 1)
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer l.Close()
+	if got := l.Addr().String(); got != "pod/ns/mypod:80" {
+		t.Errorf("Expected Addr pod/ns/mypod:80, got %s", got)
+	}
+
+	c1, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	if _, err := c1.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c1, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected echo of hello, got %q (%v)", buf, err)
+	}
+
+	// The only slot is taken until c1 is closed.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Failed to accept: %v", err)
+		}
+		accepted <- c
+	}()
+	select {
+	case <-accepted:
+		t.Fatalf("Expected Accept to block while maxConns connections are open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c1.Close()
+	select {
+	case c2 := <-accepted:
+		if c2 != nil {
+			c2.Close()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected closing a connection to free its slot")
+	}
+
+	gone, err := fw.NewListener("pod/ns/gone:80", 1)
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	var ne net.Error
+	if _, err := gone.Accept(); !errors.As(err, &ne) || !ne.Temporary() {
+		t.Errorf("Expected a temporary error for a missing pod, got %v", err)
+	}
+	gone.Close()
+	if _, err := gone.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestForwardErrorLatched(t *testing.T) {
+	srv, fw := newFakeServer(t)
+	fail := make(chan struct{})
+	srv.Handle("ns", "mypod", "80", func(c *k8sporttest.Conn) {
+		<-fail
+		c.Fail("an error occurred forwarding 80 -> 80: connection refused")
+		// Keep the data stream open, so that only the error stream can end
+		// the pending Read.
+		io.Copy(io.Discard, c)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fc, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mypod"}}, "80")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc.Close()
+
+	if fc.Err() != nil {
+		t.Errorf("Expected no error before the kubelet reports one, got %v", fc.Err())
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fc.Read(make([]byte, 1))
+		errc <- err
+	}()
+	close(fail)
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrPortRefused) {
+			t.Errorf("Expected the pending Read to fail with ErrPortRefused, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Expected the kubelet error to abort the pending Read")
+	}
+	<-fc.Done()
+
+	if _, err := fc.Read(make([]byte, 1)); !errors.Is(err, ErrPortRefused) {
+		t.Errorf("Expected later reads to fail with ErrPortRefused, got %v", err)
+	}
+	if _, err := fc.Write([]byte("late")); !errors.Is(err, ErrPortRefused) {
+		t.Errorf("Expected later writes to fail with ErrPortRefused, got %v", err)
+	}
+	if err := fc.Close(); !errors.Is(err, ErrPortRefused) {
+		t.Errorf("Expected Close to return ErrPortRefused, got %v", err)
+	}
+	if err := fc.Err(); !errors.Is(err, ErrPortRefused) {
+		t.Errorf("Expected Err to keep returning ErrPortRefused after Close, got %v", err)
+	}
+}
+
+func TestFakeServerCloseClosesConns(t *testing.T) {
+	for _, protocol := range []UpgradeProtocol{UpgradeSPDY, UpgradeWebSocket} {
+		srv := k8sporttest.NewServer()
+		srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+		fw, err := NewForwarder(srv.Config(), WithUpgradeProtocol(protocol))
+		if err != nil {
+			t.Fatalf("Failed to create Forwarder: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		fc, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}, "80")
+		if err != nil {
+			t.Fatalf("Failed to forward: %v", err)
+		}
+		defer fc.Close()
+
+		srv.Close()
+		select {
+		case <-fc.Done():
+		case <-ctx.Done():
+			t.Fatalf("Expected closing the server to close the connection with protocol %d", protocol)
+		}
+		if _, err := fc.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+			t.Errorf("Expected reads to fail with ErrStreamReset once the server is closed, got %v", err)
+		}
+	}
+}
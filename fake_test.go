@@ -0,0 +1,79 @@
+package k8sport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFakeForwarder(t *testing.T) {
+	f := NewFakeForwarder(WithNamespace("ns"))
+	f.Handle("ns", "web-0", "8080", func(c net.Conn) {
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		c.Write([]byte("echo: " + line))
+	})
+	f.AddTarget(Target{Kind: KindService, Name: "web"}, "web-0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var pf PortForwarder = f
+	conn, err := pf.DialContext(ctx, "tcp", "web.ns.svc:8080")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hi\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "echo: hi\n" {
+		t.Errorf("Expected echo of hi, got %q (%v)", line, err)
+	}
+
+	if _, err := pf.ForwardService(ctx, "ns", "api", "80"); !errors.Is(err, ErrNoReadyPods) {
+		t.Errorf("Expected ErrNoReadyPods for an unknown service, got %v", err)
+	}
+	var fe *ForwardError
+	if _, err := pf.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "gone"}}, "80"); !errors.As(err, &fe) || fe.Kind != PodNotFound {
+		t.Errorf("Expected PodNotFound, got %v", err)
+	}
+
+	fc, err := pf.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0"}}, "9090")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc.Close()
+	<-fc.Done()
+	if !errors.As(fc.Err(), &fe) || fe.Kind != PortRefused {
+		t.Errorf("Expected PortRefused, got %v", fc.Err())
+	}
+}
+
+func TestFakeForwarderIgnoresConnOptions(t *testing.T) {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("unused")
+	}
+	for name, opt := range map[string]Option{
+		"WithUpgradeProtocol": WithUpgradeProtocol(UpgradeWebSocket),
+		"WithProxy":           WithProxy(&url.URL{Scheme: "socks5", Host: "bastion:1080"}),
+		"WithProxyDialer":     WithProxyDialer(dial),
+		"WithClientset":       WithClientset(fake.NewClientset()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := NewFakeForwarder(opt)
+			f.Handle("default", "mypod", "80", func(c net.Conn) {})
+			fc, err := f.Forward(context.Background(), corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mypod"}}, "80")
+			if err != nil {
+				t.Fatalf("Failed to forward: %v", err)
+			}
+			fc.Close()
+		})
+	}
+}
@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 )
 
 // Forward maintains the previous func for backward compatibility.
@@ -29,20 +29,128 @@ func Forward(ctx context.Context, rc *rest.Config, pod corev1.Pod, port string)
 
 // Forward establishes a port forwarding connection to the specified pod on the given port.
 // It returns a net.Conn representing the connection to the pod, or an error if the connection could not be established.
+// Connections to the same pod are multiplexed over a single upgraded connection,
+// which is closed once the last FwdConn using it is closed.
+// The port may be a number or the name of a port declared by one of the pod's
+// containers; a *PortNotFoundError is returned if no container declares it.
+// Failures to forward are returned as *ForwardError. A pod without a namespace
+// is looked for in the Forwarder's default namespace.
+//
+// Dialing and creating the streams are abandoned once ctx ends, and the
+// returned error then matches ctx.Err() with errors.Is. The FwdConn outlives
+// ctx, unless the Forwarder was created WithContextBoundConns.
 func (fw *Forwarder) Forward(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error) {
-	req := fw.kc.Post().
-		Prefix("api/v1").
-		Resource("pods").
-		Name(pod.Name).
-		Namespace(pod.Namespace).
-		SubResource("portforward")
-
-	fw.m.Lock()
-	dialer := spdy.NewDialer(fw.upgrader, &http.Client{Transport: fw.transport}, "POST", req.URL())
-	conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
-	fw.m.Unlock()
+	return fw.ForwardContainer(ctx, pod, "", port)
+}
+
+// forward establishes the connection once the port has been resolved to a
+// number, retrying according to the Forwarder's retry policy.
+func (fw *Forwarder) forward(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error) {
+	start := time.Now()
+	spanCtx, span := fw.startSpan(ctx, "k8sport.Forward", pod.Namespace, pod.Name, attrPort.String(port))
+
+	var fc *FwdConn
+	err := fw.withRetry(spanCtx, func() error {
+		var err error
+		fc, err = fw.forwardOnce(spanCtx, pod, port)
+		return err
+	})
+	endSpan(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing for stream: %w", err)
+		fw.log.WarnContext(ctx, "forward failed",
+			"namespace", pod.Namespace, "pod", pod.Name, "port", port, "duration", time.Since(start), "err", err)
+		fw.metrics.ForwardFailed(pod.Namespace, pod.Name, port, err)
+		return nil, err
+	}
+	fc.log.DebugContext(ctx, "forward established", "duration", time.Since(start))
+	fw.metrics.ForwardOpened(pod.Namespace, pod.Name, port)
+	// The span and onClose must be in place before the connection's
+	// goroutines or its context can close it.
+	fc.onClose = connOptsFrom(ctx).onClose
+	fw.traceConn(ctx, fc)
+	go fc.watchErr(ctx)
+	go fc.watchConn()
+	go fc.readLoop()
+	if fw.bindsContext(ctx) {
+		fc.bindContext(ctx)
+	}
+	return fc, nil
+}
+
+// connOpts are settings for the connection of a forward that the Pool and
+// ForwardListener pass through the public forwarding methods in its context.
+type connOpts struct {
+	// unbound keeps the connection from being bound to the context, even
+	// when the Forwarder was created WithContextBoundConns, as it is handed
+	// out beyond it.
+	unbound bool
+	// onClose becomes the connection's onClose.
+	onClose func()
+}
+
+type connOptsKey struct{}
+
+func withConnOpts(ctx context.Context, o connOpts) context.Context {
+	return context.WithValue(ctx, connOptsKey{}, o)
+}
+
+func connOptsFrom(ctx context.Context) connOpts {
+	o, _ := ctx.Value(connOptsKey{}).(connOpts)
+	return o
+}
+
+// bindsContext reports whether a connection forwarded with ctx is closed once
+// ctx ends.
+func (fw *Forwarder) bindsContext(ctx context.Context) bool {
+	return fw.ctxBound && !connOptsFrom(ctx).unbound
+}
+
+// createStream creates a stream of the type set in headers on sc, in a span of
+// its own.
+func (fw *Forwarder) createStream(ctx context.Context, sc *sharedConn, pod corev1.Pod, headers http.Header) (httpstream.Stream, error) {
+	_, span := fw.startSpan(ctx, "k8sport.CreateStream", pod.Namespace, pod.Name,
+		attrPort.String(headers.Get(corev1.PortHeader)),
+		attrStreamType.String(headers.Get(corev1.StreamType)),
+		attrRequestID.String(headers.Get(corev1.PortForwardRequestIDHeader)),
+	)
+	// CreateStream waits for the kubelet's reply without watching ctx.
+	type result struct {
+		s   httpstream.Stream
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		s, err := sc.conn.CreateStream(headers)
+		ch <- result{s, err}
+	}()
+
+	var s httpstream.Stream
+	var err error
+	select {
+	case res := <-ch:
+		s, err = res.s, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.s != nil {
+				res.s.Reset()
+				sc.conn.RemoveStreams(res.s)
+			}
+		}()
+		err = ctx.Err()
+	}
+	endSpan(span, err)
+	fw.log.DebugContext(ctx, "created stream",
+		"namespace", pod.Namespace, "pod", pod.Name, "port", headers.Get(corev1.PortHeader),
+		"request_id", headers.Get(corev1.PortForwardRequestIDHeader), "type", headers.Get(corev1.StreamType), "err", err)
+	return s, err
+}
+
+// forwardOnce creates the stream pair of a new connection. The connection's
+// goroutines are left for the caller to start.
+func (fw *Forwarder) forwardOnce(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error) {
+	sc, err := fw.acquire(ctx, pod)
+	if err != nil {
+		return nil, dialError(pod.Namespace, pod.Name, port, err)
 	}
 
 	headers := http.Header{}
@@ -52,28 +160,36 @@ func (fw *Forwarder) Forward(ctx context.Context, pod corev1.Pod, port string) (
 	next := fw.reqID.Add(1)
 	headers.Set(v1.PortForwardRequestIDHeader, strconv.Itoa(int(next)))
 
-	errorStream, err := conn.CreateStream(headers)
+	errorStream, err := fw.createStream(ctx, sc, pod, headers)
 	if err != nil {
-		return nil, fmt.Errorf("error creating err stream: %w", err)
+		fw.release(sc)
+		return nil, &ForwardError{
+			Kind:      StreamReset,
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Port:      port,
+			Err:       fmt.Errorf("error creating err stream: %w", err),
+		}
 	}
 	// We won't need to write to this.
 	errorStream.Close()
 
 	headers.Set(corev1.StreamType, corev1.StreamTypeData)
-	dataStream, err := conn.CreateStream(headers)
+	dataStream, err := fw.createStream(ctx, sc, pod, headers)
 	if err != nil {
-		return nil, fmt.Errorf("error creating data stream: %w", err)
+		errorStream.Reset()
+		sc.conn.RemoveStreams(errorStream)
+		fw.release(sc)
+		return nil, &ForwardError{
+			Kind:      StreamReset,
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Port:      port,
+			Err:       fmt.Errorf("error creating data stream: %w", err),
+		}
 	}
 
-	fc := &FwdConn{
-		fwd:   conn,
-		port:  port,
-		err:   errorStream,
-		errch: make(chan error),
-		data:  dataStream,
-		pod:   pod,
-	}
-	go fc.watchErr(ctx)
-
+	fc := newFwdConn(fw, sc, pod, port, dataStream, errorStream)
+	fc.log = fc.log.With("request_id", next)
 	return fc, nil
 }
@@ -1,46 +1,126 @@
 package k8sport
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
+	"k8s.io/client-go/transport/websocket"
 )
 
 var (
-	ErrRestConfigInvalid = fmt.Errorf("rest config is invalid")
+	ErrRestConfigInvalid    = fmt.Errorf("rest config is invalid")
+	ErrClientsetUnsupported = fmt.Errorf("clientset is not supported")
 )
 
 type Forwarder struct {
 	kc        rest.Interface
-	m         sync.Mutex
+	dialMu    chan struct{} // see lockDial
 	transport http.RoundTripper
 	upgrader  spdy.Upgrader
 
+	upgrade     UpgradeProtocol
+	wsTransport http.RoundTripper
+	wsHolder    websocket.ConnectionHolder
+
+	proxyURL  *url.URL
+	proxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	reqID atomic.Int32
+
+	// conns holds the upgraded connections to every pod, keyed by podKey.
+	connsMu sync.Mutex
+	conns   map[string][]*sharedConn
+
+	namespace   string
+	log         *slog.Logger
+	metrics     Metrics
+	tracer      trace.Tracer
+	connSpans   bool
+	ctxBound    bool
+	retry       *RetryPolicy
+	maxStreams  int
+	dialTimeout time.Duration
+	protocols   []string
+
+	// optErr is set by an option that cannot be applied, and returned by
+	// NewForwarder.
+	optErr error
 }
 
 // NewForwarder takes a Kubernetes REST configuration and returns a new
 // Forwarder instance. This instance can be used to establish port forwarding
-// connections to pods in the Kubernetes cluster reusing an underlying SPDY dialer.
-func NewForwarder(rc *rest.Config) (*Forwarder, error) {
-	cs, err := kubernetes.NewForConfig(rc)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrRestConfigInvalid, err)
+// connections to pods in the Kubernetes cluster reusing an underlying SPDY dialer
+// and a single upgraded connection per pod. rc may be nil if both WithRESTClient
+// and WithRoundTripper are given.
+func NewForwarder(rc *rest.Config, opts ...Option) (*Forwarder, error) {
+	fw := &Forwarder{
+		conns:     map[string][]*sharedConn{},
+		dialMu:    make(chan struct{}, 1),
+		namespace: DefaultNamespace,
+		log:       slog.New(slog.DiscardHandler),
+		metrics:   nopMetrics{},
+		tracer:    otel.Tracer(tracerName),
+		protocols: []string{portforward.PortForwardProtocolV1Name},
+	}
+	for _, opt := range opts {
+		opt(fw)
+	}
+	if fw.optErr != nil {
+		return nil, fw.optErr
 	}
 
-	transport, upgrader, err := spdy.RoundTripperFor(rc)
+	rc, err := fw.proxyConfig(rc)
 	if err != nil {
-		return nil, fmt.Errorf("error creating spdy roundtripper: %w", err)
+		return nil, err
 	}
 
-	return &Forwarder{
-		kc:        cs.RESTClient(),
-		transport: transport,
-		upgrader:  upgrader,
-	}, nil
+	if (fw.kc == nil || fw.transport == nil) && rc == nil {
+		return nil, fmt.Errorf("%w: nil", ErrRestConfigInvalid)
+	}
+	if fw.kc == nil {
+		cs, err := kubernetes.NewForConfig(rc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRestConfigInvalid, err)
+		}
+		fw.kc = cs.RESTClient()
+	}
+	if fw.transport == nil {
+		var (
+			transport http.RoundTripper
+			upgrader  spdy.Upgrader
+		)
+		if fw.proxyDial != nil {
+			transport, upgrader, err = dialerRoundTripper(rc, fw.proxyDial)
+		} else {
+			transport, upgrader, err = spdy.RoundTripperFor(rc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error creating spdy roundtripper: %w", err)
+		}
+		fw.transport, fw.upgrader = transport, upgrader
+	}
+	if fw.upgrade != UpgradeSPDY {
+		if rc == nil {
+			return nil, fmt.Errorf("%w: nil, but needed for WebSockets", ErrRestConfigInvalid)
+		}
+		wsTransport, wsHolder, err := websocket.RoundTripperFor(rc)
+		if err != nil {
+			return nil, fmt.Errorf("error creating websocket roundtripper: %w", err)
+		}
+		fw.wsTransport, fw.wsHolder = wsTransport, wsHolder
+	}
+	return fw, nil
 }
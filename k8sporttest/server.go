@@ -0,0 +1,391 @@
+// Package k8sporttest provides an in-memory stand-in for the apiserver and
+// kubelet, so that code using port forwards can be tested without a cluster.
+//
+// A Server accepts the SPDY upgrade of a pod's portforward subresource, as
+// well as the WebSocket one that tunnels SPDY, and hands the data stream of
+// every forwarded connection to the Handler registered for that pod and port:
+//
+//	srv := k8sporttest.NewServer()
+//	defer srv.Close()
+//	srv.Handle("default", "mypod", "80", k8sporttest.Echo)
+//
+//	fwd, err := k8sport.NewForwarder(srv.Config())
+package k8sporttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	gwebsocket "github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/apimachinery/pkg/util/httpstream/wsstream"
+	constants "k8s.io/apimachinery/pkg/util/portforward"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// Handler serves one forwarded connection, as the process listening on the
+// port inside the pod would. The connection is closed once it returns.
+type Handler func(c *Conn)
+
+// Echo is a Handler that writes back everything it reads.
+func Echo(c *Conn) {
+	io.Copy(c, c)
+}
+
+// Conn is a forwarded connection as seen from the pod.
+type Conn struct {
+	Namespace, Pod, Port string
+	// RequestID is the request ID the client gave the stream pair.
+	RequestID string
+
+	data, err httpstream.Stream
+	failOnce  sync.Once
+}
+
+// Read reads what the client wrote. It returns io.EOF once the client has
+// closed its writing side.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.data.Read(b)
+}
+
+// Write writes to the client.
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.data.Write(b)
+}
+
+// Close closes the writing side of the connection, so that the client reads
+// io.EOF.
+func (c *Conn) Close() error {
+	return c.data.Close()
+}
+
+// Fail sends message on the connection's error stream, as the kubelet does
+// when it cannot forward to the port, and closes the error stream. Only the
+// first call has an effect.
+func (c *Conn) Fail(message string) {
+	c.failOnce.Do(func() {
+		io.WriteString(c.err, message)
+		c.err.Close()
+	})
+}
+
+// Server is an httptest.Server that serves pods and their portforward
+// subresource like the apiserver, forwarding to in-process handlers instead
+// of containers.
+type Server struct {
+	// URL is the base URL of the server.
+	URL string
+
+	srv *httptest.Server
+
+	mu               sync.Mutex
+	pods             map[string]corev1.Pod
+	handlers         map[string]Handler
+	upgrades         int
+	wsUpgrades       int
+	rejectWebSockets bool
+
+	// conns are the upgraded connections being served, which the
+	// httptest.Server no longer tracks once they are hijacked.
+	conns  map[httpstream.Connection]struct{}
+	closed bool
+}
+
+// NewServer starts a Server with no pods. It must be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		pods:     map[string]corev1.Pod{},
+		handlers: map[string]Handler{},
+		conns:    map[httpstream.Connection]struct{}{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down, closing all upgraded connections as if the
+// apiserver went away.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = map[httpstream.Connection]struct{}{}
+	s.mu.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// Config returns a rest.Config for the server.
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{Host: s.URL}
+}
+
+// AddPod makes the server return pod when it is fetched, so that clients can
+// resolve its named ports and check its status. Pods that are only known from
+// Handle are returned running and ready, without containers.
+func (s *Server) AddPod(pod corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pods[pod.Namespace+"/"+pod.Name] = pod
+}
+
+// Handle makes the server serve connections forwarded to the port of the pod
+// with h. Forwards to ports of the pod without a handler are refused on the
+// error stream, like those to a port nothing listens on.
+func (s *Server) Handle(namespace, pod, port string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := namespace + "/" + pod
+	if _, ok := s.pods[key]; !ok {
+		s.pods[key] = corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: pod},
+			Status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			},
+		}
+	}
+	s.handlers[key+":"+port] = h
+}
+
+// RejectWebSockets makes the server refuse WebSocket upgrades, like
+// apiservers without the PortForwardWebsockets feature, so that clients fall
+// back to SPDY.
+func (s *Server) RejectWebSockets() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectWebSockets = true
+}
+
+// Upgrades returns the number of connections upgraded so far, with either
+// protocol.
+func (s *Server) Upgrades() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upgrades
+}
+
+// WebSocketUpgrades returns the number of connections upgraded to WebSockets
+// so far.
+func (s *Server) WebSocketUpgrades() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wsUpgrades
+}
+
+func (s *Server) pod(namespace, name string) (corev1.Pod, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pod, ok := s.pods[namespace+"/"+name]
+	return pod, ok
+}
+
+func (s *Server) handler(namespace, pod, port string) Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handlers[namespace+"/"+pod+":"+port]
+}
+
+// serveHTTP serves /api/v1/namespaces/{namespace}/pods/{name} and its
+// portforward subresource.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 6 || parts[0] != "api" || parts[1] != "v1" || parts[2] != "namespaces" || parts[4] != "pods" {
+		WriteStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "the server could not find the requested resource")
+		return
+	}
+	namespace, name := parts[3], parts[5]
+	pod, ok := s.pod(namespace, name)
+	if !ok {
+		WriteStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("pods %q not found", name))
+		return
+	}
+
+	switch {
+	case len(parts) == 6 && r.Method == http.MethodGet:
+		pod.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pod)
+	case len(parts) == 7 && parts[6] == "portforward" && r.Method == http.MethodPost:
+		s.portForward(w, r, namespace, name)
+	case len(parts) == 7 && parts[6] == "portforward" && r.Method == http.MethodGet && wsstream.IsWebSocketRequest(r):
+		s.portForwardWebSocket(w, r, namespace, name)
+	default:
+		WriteStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+	}
+}
+
+// portForward upgrades the request to SPDY and serves the stream pairs the
+// client creates on the connection until it is closed.
+func (s *Server) portForward(w http.ResponseWriter, r *http.Request, namespace, pod string) {
+	if _, err := httpstream.Handshake(r, w, []string{portforward.PortForwardProtocolV1Name}); err != nil {
+		return
+	}
+
+	streams, done, handler := newStreamHandler()
+	defer close(done)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, handler)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	if !s.track(conn, false) {
+		return
+	}
+	defer s.untrack(conn)
+	s.serveStreams(conn, streams, namespace, pod)
+}
+
+// portForwardWebSocket upgrades the request to a WebSocket connection that
+// tunnels SPDY, as the apiserver does, and serves it like portForward.
+func (s *Server) portForwardWebSocket(w http.ResponseWriter, r *http.Request, namespace, pod string) {
+	s.mu.Lock()
+	reject := s.rejectWebSockets
+	s.mu.Unlock()
+	if reject {
+		WriteStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "Upgrade request required")
+		return
+	}
+
+	upgrader := gwebsocket.Upgrader{
+		Subprotocols: []string{constants.WebsocketsSPDYTunnelingPrefix + portforward.PortForwardProtocolV1Name},
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied.
+		return
+	}
+	tunnel := portforward.NewTunnelingConnection("server", ws)
+	defer tunnel.Close()
+
+	streams, done, handler := newStreamHandler()
+	defer close(done)
+	conn, err := spdy.NewServerConnection(tunnel, handler)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if !s.track(conn, true) {
+		return
+	}
+	defer s.untrack(conn)
+	s.serveStreams(conn, streams, namespace, pod)
+}
+
+// track counts an upgraded connection and remembers it so that Close can
+// close it. It reports false if the server has been closed already.
+func (s *Server) track(conn httpstream.Connection, websocket bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.upgrades++
+	if websocket {
+		s.wsUpgrades++
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn httpstream.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// newStreamHandler returns a handler for the streams the client creates, which
+// passes each on once its reply has been sent, until done is closed.
+func newStreamHandler() (<-chan httpstream.Stream, chan struct{}, httpstream.NewStreamHandler) {
+	streams := make(chan httpstream.Stream)
+	done := make(chan struct{})
+	return streams, done, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		go func() {
+			<-replySent
+			select {
+			case streams <- stream:
+			case <-done:
+			}
+		}()
+		return nil
+	}
+}
+
+// serveStreams serves the stream pairs created on conn until it is closed.
+func (s *Server) serveStreams(conn httpstream.Connection, streams <-chan httpstream.Stream, namespace, pod string) {
+	// The error and data streams of a connection are paired by request ID.
+	pending := map[string]*Conn{}
+	for {
+		var stream httpstream.Stream
+		select {
+		case stream = <-streams:
+		case <-conn.CloseChan():
+			return
+		}
+
+		h := stream.Headers()
+		id := h.Get(corev1.PortForwardRequestIDHeader)
+		c, ok := pending[id]
+		if !ok {
+			c = &Conn{Namespace: namespace, Pod: pod, Port: h.Get(corev1.PortHeader), RequestID: id}
+			pending[id] = c
+		}
+		switch h.Get(corev1.StreamType) {
+		case corev1.StreamTypeError:
+			c.err = stream
+		case corev1.StreamTypeData:
+			c.data = stream
+		default:
+			stream.Reset()
+			continue
+		}
+		if c.err == nil || c.data == nil {
+			continue
+		}
+		delete(pending, id)
+		go s.serveConn(conn, c)
+	}
+}
+
+func (s *Server) serveConn(conn httpstream.Connection, c *Conn) {
+	defer conn.RemoveStreams(c.data, c.err)
+	defer c.data.Close()
+	defer c.err.Close()
+
+	h := s.handler(c.Namespace, c.Pod, c.Port)
+	if h == nil {
+		c.Fail(fmt.Sprintf("an error occurred forwarding %s -> %s: error forwarding port %s to pod %s: "+
+			"dial tcp4 127.0.0.1:%s: connect: connection refused", c.Port, c.Port, c.Port, c.Pod, c.Port))
+		return
+	}
+	h(c)
+}
+
+// WriteStatus replies to a request with a failure Status, as the apiserver
+// does, for stub apiservers in tests that need more than a Server serves.
+func WriteStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   reason,
+		Message:  message,
+		Code:     int32(code),
+	})
+}
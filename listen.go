@@ -0,0 +1,202 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// LocalForward exposes a forwarded target on a local listener, like kubectl
+// port-forward does. Every accepted client gets its own FwdConn, and bytes are
+// copied in both directions until both sides are done.
+type LocalForward struct {
+	dialer Dialer
+	l      net.Listener
+	remote string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	active map[net.Conn]struct{}
+	wg     sync.WaitGroup
+
+	done chan struct{}
+	err  error
+}
+
+// Listen binds localAddr, such as "127.0.0.1:8080" or ":0", and forwards every
+// client to remoteAddr, which takes any of the forms accepted by DialContext.
+// Cancelling ctx closes the listener and all forwarded connections.
+func (fw *Forwarder) Listen(ctx context.Context, localAddr, remoteAddr string) (*LocalForward, error) {
+	d := Dialer{Forwarder: fw}
+	if _, _, err := d.ParseAddr(remoteAddr); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	return fw.Serve(ctx, l, remoteAddr)
+}
+
+// Serve is like Listen but accepts clients from an existing listener, which it
+// takes ownership of.
+func (fw *Forwarder) Serve(ctx context.Context, l net.Listener, remoteAddr string) (*LocalForward, error) {
+	d := Dialer{Forwarder: fw}
+	if _, _, err := d.ParseAddr(remoteAddr); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	lf := &LocalForward{
+		dialer: d,
+		l:      l,
+		remote: remoteAddr,
+		ctx:    ctx,
+		cancel: cancel,
+		active: map[net.Conn]struct{}{},
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go lf.acceptLoop()
+
+	return lf, nil
+}
+
+// Addr returns the local address clients connect to.
+func (lf *LocalForward) Addr() net.Addr {
+	return lf.l.Addr()
+}
+
+// Done returns a channel that is closed once the listener stops accepting.
+func (lf *LocalForward) Done() <-chan struct{} {
+	return lf.done
+}
+
+// Err returns the error that stopped the listener, or nil if it was closed.
+// It is only meaningful once Done is closed.
+func (lf *LocalForward) Err() error {
+	<-lf.done
+	return lf.err
+}
+
+// Close stops accepting clients and closes every forwarded connection.
+func (lf *LocalForward) Close() error {
+	lf.cancel()
+	<-lf.done
+
+	lf.mu.Lock()
+	for c := range lf.active {
+		c.Close()
+	}
+	lf.mu.Unlock()
+
+	lf.wg.Wait()
+	return nil
+}
+
+// Shutdown stops accepting clients and waits for the forwarded connections to
+// finish on their own. If ctx ends first, the remaining connections are
+// closed and ctx's error is returned.
+func (lf *LocalForward) Shutdown(ctx context.Context) error {
+	lf.l.Close()
+	<-lf.done
+
+	finished := make(chan struct{})
+	go func() {
+		lf.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		lf.cancel()
+		return nil
+	case <-ctx.Done():
+		lf.Close()
+		return ctx.Err()
+	}
+}
+
+func (lf *LocalForward) acceptLoop() {
+	defer close(lf.done)
+	for {
+		client, err := lf.l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && lf.ctx.Err() == nil {
+				lf.err = err
+			}
+			return
+		}
+
+		lf.track(client, true)
+		lf.wg.Add(1)
+		go func() {
+			defer lf.wg.Done()
+			defer lf.track(client, false)
+			lf.handle(client)
+		}()
+	}
+}
+
+func (lf *LocalForward) track(c net.Conn, add bool) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if add {
+		lf.active[c] = struct{}{}
+	} else {
+		delete(lf.active, c)
+	}
+}
+
+func (lf *LocalForward) handle(client net.Conn) {
+	defer client.Close()
+
+	remote, err := lf.dialer.DialContext(lf.ctx, "tcp", lf.remote)
+	if err != nil {
+		if lf.ctx.Err() == nil {
+			lf.dialer.Forwarder.log.WarnContext(lf.ctx, "failed to forward client",
+				"client", client.RemoteAddr().String(), "remote", lf.remote, "err", err)
+		}
+		return
+	}
+	lf.track(remote, true)
+	defer lf.track(remote, false)
+
+	proxy(client, remote)
+}
+
+// proxy copies between a and b until both directions are done. When one side
+// finishes sending, the other is half-closed if it supports CloseWrite, so
+// the response can still be read; errors tear down both.
+func proxy(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
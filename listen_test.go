@@ -0,0 +1,93 @@
+package k8sport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+// syncBuffer is a bytes.Buffer that can be written to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLocalForward(t *testing.T) {
+	srv := k8sporttest.NewServer()
+	defer srv.Close()
+	// The pod answers once the client is done sending, so the answer can only
+	// arrive if the half-close made it through.
+	srv.Handle("ns", "mypod", "80", func(c *k8sporttest.Conn) {
+		b, _ := io.ReadAll(c)
+		c.Write([]byte("got: " + string(b)))
+	})
+	var logs syncBuffer
+	fw, err := NewForwarder(srv.Config(), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lf, err := fw.Listen(ctx, "127.0.0.1:0", "pod/ns/mypod:80")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lf.Close()
+
+	c, err := net.Dial("tcp", lf.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Failed to close writing side: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "got: hello" {
+		t.Errorf("Expected got: hello, got %q (%v)", b, err)
+	}
+
+	// Clients whose forward fails are disconnected, and the failure logged.
+	lf2, err := fw.Listen(ctx, "127.0.0.1:0", "pod/ns/gone:80")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lf2.Close()
+	c2, err := net.Dial("tcp", lf2.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the client to be disconnected, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "failed to forward client") || !strings.Contains(logs.String(), "pod/ns/gone:80") {
+		t.Errorf("Expected the failure to be logged, got %q", logs.String())
+	}
+}
@@ -0,0 +1,99 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ForwardListener is a net.Listener whose Accept forwards a new connection to
+// a target instead of waiting for an inbound one. It lets servers and agents
+// that are built around a listener, such as http.Server, gRPC servers or
+// reverse tunnel agents, run directly over port forwards.
+type ForwardListener struct {
+	dialer Dialer
+	remote string
+
+	// sem holds a token for every open connection.
+	sem chan struct{}
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// acceptError marks dial failures as temporary, so that servers back off and
+// call Accept again rather than giving up.
+type acceptError struct {
+	err error
+}
+
+func (e *acceptError) Error() string   { return e.err.Error() }
+func (e *acceptError) Unwrap() error   { return e.err }
+func (e *acceptError) Timeout() bool   { return false }
+func (e *acceptError) Temporary() bool { return true }
+
+// NewListener returns a listener whose Accept forwards to remoteAddr, which
+// takes any of the forms accepted by DialContext. Accept blocks while maxConns
+// of its connections are open; maxConns must be positive.
+func (fw *Forwarder) NewListener(remoteAddr string, maxConns int) (*ForwardListener, error) {
+	if maxConns <= 0 {
+		return nil, fmt.Errorf("maxConns must be positive, got %d", maxConns)
+	}
+	d := Dialer{Forwarder: fw}
+	if _, _, err := d.ParseAddr(remoteAddr); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ForwardListener{
+		dialer: d,
+		remote: remoteAddr,
+		sem:    make(chan struct{}, maxConns),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Accept forwards a new connection, returned as a *FwdConn. Failures to
+// forward are returned as temporary net.Errors. Once the listener is closed,
+// Accept returns net.ErrClosed.
+func (l *ForwardListener) Accept() (net.Conn, error) {
+	if l.ctx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+
+	// Accepted connections outlive the listener, so they are not bound to
+	// its context, and give their slot back once closed.
+	ctx := withConnOpts(l.ctx, connOpts{unbound: true, onClose: l.releaseSlot})
+	conn, err := l.dialer.DialContext(ctx, "tcp", l.remote)
+	if err != nil {
+		l.releaseSlot()
+		if l.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		return nil, &acceptError{err: err}
+	}
+	return conn, nil
+}
+
+func (l *ForwardListener) releaseSlot() {
+	<-l.sem
+}
+
+// Close stops Accept. Connections that were already accepted stay open.
+func (l *ForwardListener) Close() error {
+	l.closeOnce.Do(l.cancel)
+	return nil
+}
+
+// Addr returns the address connections are forwarded to.
+func (l *ForwardListener) Addr() net.Addr {
+	return fwdAddr(l.remote)
+}
@@ -0,0 +1,36 @@
+package k8sport
+
+import "time"
+
+// Metrics receives measurements from a Forwarder and its connections.
+// Implementations must be safe for concurrent use and should return quickly,
+// as some methods are called on every Read and Write. PrometheusMetrics is a
+// ready-made implementation.
+type Metrics interface {
+	// DialDone is called after every attempt to upgrade a connection to a pod.
+	DialDone(namespace, pod string, d time.Duration, err error)
+	// ForwardOpened is called when a FwdConn has been established.
+	ForwardOpened(namespace, pod, port string)
+	// ForwardFailed is called when establishing a FwdConn failed, after any
+	// retries.
+	ForwardFailed(namespace, pod, port string, err error)
+	// ForwardClosed is called when a FwdConn is closed.
+	ForwardClosed(namespace, pod, port string)
+	// BytesRead and BytesWritten are called with the number of bytes every
+	// Read and Write moves, if any.
+	BytesRead(namespace, pod, port string, n int)
+	BytesWritten(namespace, pod, port string, n int)
+	// StreamError is called when the kubelet reports an error on the error
+	// stream of a FwdConn, or the error stream breaks.
+	StreamError(namespace, pod, port string, kind ErrorKind)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) DialDone(string, string, time.Duration, error) {}
+func (nopMetrics) ForwardOpened(string, string, string)          {}
+func (nopMetrics) ForwardFailed(string, string, string, error)   {}
+func (nopMetrics) ForwardClosed(string, string, string)          {}
+func (nopMetrics) BytesRead(string, string, string, int)         {}
+func (nopMetrics) BytesWritten(string, string, string, int)      {}
+func (nopMetrics) StreamError(string, string, string, ErrorKind) {}
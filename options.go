@@ -0,0 +1,150 @@
+package k8sport
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// DefaultNamespace is the namespace used for pods and targets that do not
+// name one, unless WithNamespace says otherwise.
+const DefaultNamespace = "default"
+
+// Option configures a Forwarder.
+type Option func(*Forwarder)
+
+// WithRESTClient makes the Forwarder use kc for its requests to the apiserver
+// instead of one built from the rest.Config. kc must be rooted at the
+// apiserver, like the RESTClient of a clientset's Discovery client, as the
+// Forwarder adds the API group paths itself.
+func WithRESTClient(kc rest.Interface) Option {
+	return func(fw *Forwarder) {
+		fw.kc = kc
+	}
+}
+
+// WithClientset makes the Forwarder use the REST client of cs for its requests
+// to the apiserver. See WithRESTClient. Clientsets without one, such as the
+// fake clientset of k8s.io/client-go/kubernetes/fake, are not supported and
+// make NewForwarder fail.
+func WithClientset(cs kubernetes.Interface) Option {
+	return func(fw *Forwarder) {
+		kc := cs.Discovery().RESTClient()
+		if kc == nil {
+			fw.optErr = fmt.Errorf("%w: clientset %T has no REST client", ErrClientsetUnsupported, cs)
+			return
+		}
+		fw.kc = kc
+	}
+}
+
+// WithRoundTripper makes the Forwarder upgrade connections with the given
+// transport and upgrader, as returned by spdy.RoundTripperFor, instead of ones
+// built from the rest.Config.
+func WithRoundTripper(transport http.RoundTripper, upgrader spdy.Upgrader) Option {
+	return func(fw *Forwarder) {
+		fw.transport = transport
+		fw.upgrader = upgrader
+	}
+}
+
+// WithNamespace sets the namespace used for pods, targets and addresses that do
+// not name one. It defaults to DefaultNamespace.
+func WithNamespace(namespace string) Option {
+	return func(fw *Forwarder) {
+		fw.namespace = namespace
+	}
+}
+
+// WithLogger makes the Forwarder log to l. Dials, stream creation and
+// connections closing are logged at debug level, failed forwards and errors
+// reported by the kubelet at warn level, with the namespace, pod, port and
+// request ID of the connection. By default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(fw *Forwarder) {
+		if l != nil {
+			fw.log = l
+		}
+	}
+}
+
+// WithMetrics makes the Forwarder report to m.
+func WithMetrics(m Metrics) Option {
+	return func(fw *Forwarder) {
+		if m != nil {
+			fw.metrics = m
+		}
+	}
+}
+
+// WithTracerProvider makes the Forwarder create its spans with tp instead of
+// the global TracerProvider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(fw *Forwarder) {
+		if tp != nil {
+			fw.tracer = tp.Tracer(tracerName)
+		}
+	}
+}
+
+// WithConnSpans makes every FwdConn record a span from when it is established
+// until it is closed, carrying the bytes read and written and why it was
+// closed. Errors reported by the kubelet are recorded on it as they arrive.
+func WithConnSpans() Option {
+	return func(fw *Forwarder) {
+		fw.connSpans = true
+	}
+}
+
+// WithContextBoundConns ties every FwdConn to the context passed to Forward:
+// once it ends, the connection is closed, and pending and later Read and Write
+// calls return an error matching both net.ErrClosed and the context's error.
+// Connections from a Pool or ForwardListener are not bound, as they are used
+// beyond the Get or Accept that forwarded them.
+func WithContextBoundConns() Option {
+	return func(fw *Forwarder) {
+		fw.ctxBound = true
+	}
+}
+
+// WithRetryPolicy makes the Forwarder retry failed dials and stream creation
+// according to p, whose zero fields default to those of DefaultRetryPolicy,
+// so that RetryPolicy{} gives up after a minute. Without it, failures are
+// returned immediately.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(fw *Forwarder) {
+		fw.retry = &p
+	}
+}
+
+// WithMaxStreamsPerConn limits how many FwdConns share one upgraded connection
+// to a pod. Once every connection to the pod carries n of them, Forward dials
+// another one. Zero, the default, puts all of them on one connection.
+func WithMaxStreamsPerConn(n int) Option {
+	return func(fw *Forwarder) {
+		fw.maxStreams = n
+	}
+}
+
+// WithDialTimeout bounds how long upgrading a connection to a pod may take.
+// Zero, the default, leaves it to the transport.
+func WithDialTimeout(d time.Duration) Option {
+	return func(fw *Forwarder) {
+		fw.dialTimeout = d
+	}
+}
+
+// WithProtocols sets the port forward subprotocols offered when upgrading, in
+// order of preference. It defaults to portforward.PortForwardProtocolV1Name,
+// the only one kubelets speak over SPDY.
+func WithProtocols(protocols ...string) Option {
+	return func(fw *Forwarder) {
+		fw.protocols = protocols
+	}
+}
@@ -0,0 +1,271 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	ErrPoolClosed = fmt.Errorf("pool is closed")
+)
+
+// DefaultPoolConfig holds the values used for unset PoolConfig fields.
+var DefaultPoolConfig = PoolConfig{
+	MaxIdlePerKey: 2,
+	IdleTimeout:   90 * time.Second,
+}
+
+// PoolConfig configures a Pool.
+type PoolConfig struct {
+	// MaxIdlePerKey is how many idle connections are kept for every pod and
+	// port. Connections put back beyond it are closed.
+	MaxIdlePerKey int
+	// IdleTimeout is how long a connection may stay idle before it is closed.
+	IdleTimeout time.Duration
+}
+
+// PoolStats is a snapshot of a Pool's counters.
+type PoolStats struct {
+	// Idle and InUse are the numbers of connections currently in the pool
+	// and handed out by it.
+	Idle, InUse int
+	// Hits and Misses count the calls to Get that reused an idle connection
+	// and those that forwarded a new one.
+	Hits, Misses uint64
+	// Evictions counts the idle connections closed because they broke, timed
+	// out or did not fit in the pool.
+	Evictions uint64
+}
+
+type poolKey struct {
+	namespace, pod, port string
+}
+
+type idleConn struct {
+	fc    *FwdConn
+	since time.Time
+}
+
+// Pool keeps idle FwdConns warm for reuse, so that clients making many short
+// requests to the same pods do not set up a new pair of streams each time.
+// Connections are taken with Get and given back with Put once the exchange on
+// them is complete; the pod must be ready for a new exchange on the same
+// connection, as with HTTP keep-alive.
+type Pool struct {
+	fw  *Forwarder
+	cfg PoolConfig
+
+	mu     sync.Mutex
+	idle   map[poolKey][]idleConn
+	out    map[*FwdConn]poolKey
+	stats  PoolStats
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPool returns an empty pool that forwards through fw. Zero cfg fields take
+// their values from DefaultPoolConfig.
+func (fw *Forwarder) NewPool(cfg PoolConfig) *Pool {
+	if cfg.MaxIdlePerKey <= 0 {
+		cfg.MaxIdlePerKey = DefaultPoolConfig.MaxIdlePerKey
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultPoolConfig.IdleTimeout
+	}
+
+	p := &Pool{
+		fw:   fw,
+		cfg:  cfg,
+		idle: map[poolKey][]idleConn{},
+		out:  map[*FwdConn]poolKey{},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go p.evictLoop()
+	return p
+}
+
+// Get returns an idle connection to the pod and port if there is a usable one,
+// or forwards a new one with ctx otherwise. Idle connections that broke while
+// in the pool are closed rather than returned.
+func (p *Pool) Get(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error) {
+	p.fw.defaultNamespace(&pod)
+	key := poolKey{namespace: pod.Namespace, pod: pod.Name, port: port}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	for len(p.idle[key]) > 0 {
+		conns := p.idle[key]
+		ic := conns[len(conns)-1]
+		p.setIdle(key, conns[:len(conns)-1])
+
+		if err := ic.fc.idleErr(); err != nil {
+			p.stats.Evictions++
+			p.mu.Unlock()
+			p.evict(ic.fc, "broken", err)
+			p.mu.Lock()
+			continue
+		}
+		p.out[ic.fc] = key
+		p.stats.Hits++
+		p.mu.Unlock()
+		return ic.fc, nil
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+
+	// Connections are lent to later callers too, so they must not be bound
+	// to this one's context.
+	fc, err := p.fw.Forward(withConnOpts(ctx, connOpts{unbound: true}), pod, port)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		fc.Close()
+		return nil, ErrPoolClosed
+	}
+	p.out[fc] = key
+	return fc, nil
+}
+
+// Put gives a connection taken with Get back to the pool, clearing its
+// deadlines. Connections that are broken, half-closed or have unread data, and
+// those the pool has no room for, are closed instead. Connections that did not
+// come from this pool are closed as well.
+func (p *Pool) Put(fc *FwdConn) {
+	p.mu.Lock()
+	key, ok := p.out[fc]
+	delete(p.out, fc)
+	if !ok || p.closed {
+		p.mu.Unlock()
+		fc.Close()
+		return
+	}
+
+	fc.SetDeadline(time.Time{})
+	if err := fc.idleErr(); err != nil {
+		p.stats.Evictions++
+		p.mu.Unlock()
+		p.evict(fc, "broken", err)
+		return
+	}
+	if len(p.idle[key]) >= p.cfg.MaxIdlePerKey {
+		p.stats.Evictions++
+		p.mu.Unlock()
+		p.evict(fc, "pool full", nil)
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleConn{fc: fc, since: time.Now()})
+	p.mu.Unlock()
+}
+
+// Stats returns the pool's current counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	for _, conns := range p.idle {
+		stats.Idle += len(conns)
+	}
+	stats.InUse = len(p.out)
+	return stats
+}
+
+// Close closes the idle connections and makes Get fail with ErrPoolClosed.
+// Connections that are in use are closed when they are put back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = map[poolKey][]idleConn{}
+	p.mu.Unlock()
+
+	close(p.stop)
+	<-p.done
+
+	for _, conns := range idle {
+		for _, ic := range conns {
+			ic.fc.Close()
+		}
+	}
+	return nil
+}
+
+// setIdle replaces the idle connections of key. p.mu must be held.
+func (p *Pool) setIdle(key poolKey, conns []idleConn) {
+	if len(conns) == 0 {
+		delete(p.idle, key)
+		return
+	}
+	p.idle[key] = conns
+}
+
+// evictLoop periodically closes idle connections that timed out or broke.
+func (p *Pool) evictLoop() {
+	defer close(p.done)
+
+	t := time.NewTicker(p.cfg.IdleTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.evictIdle()
+		}
+	}
+}
+
+func (p *Pool) evictIdle() {
+	type eviction struct {
+		fc     *FwdConn
+		reason string
+		err    error
+	}
+	var evicted []eviction
+
+	p.mu.Lock()
+	for key, conns := range p.idle {
+		kept := conns[:0]
+		for _, ic := range conns {
+			switch err := ic.fc.idleErr(); {
+			case err != nil:
+				evicted = append(evicted, eviction{ic.fc, "broken", err})
+			case time.Since(ic.since) >= p.cfg.IdleTimeout:
+				evicted = append(evicted, eviction{ic.fc, "idle timeout", nil})
+			default:
+				kept = append(kept, ic)
+			}
+		}
+		p.setIdle(key, kept)
+	}
+	p.stats.Evictions += uint64(len(evicted))
+	p.mu.Unlock()
+
+	for _, e := range evicted {
+		p.evict(e.fc, e.reason, e.err)
+	}
+}
+
+func (p *Pool) evict(fc *FwdConn, reason string, err error) {
+	p.fw.log.Debug("evicting pooled connection",
+		"namespace", fc.pod.Namespace, "pod", fc.pod.Name, "port", fc.port, "reason", reason, "err", err)
+	fc.Close()
+}
@@ -0,0 +1,81 @@
+package k8sport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newStubSharedConn returns a dialed shared connection to the pod over a
+// pipeConnection.
+func newStubSharedConn(pod corev1.Pod) *sharedConn {
+	sc := &sharedConn{key: podKey(pod), conn: newPipeConnection(), refs: 1, ready: make(chan struct{})}
+	close(sc.ready)
+	return sc
+}
+
+// newPooledFwdConn returns a FwdConn over a pipe that p believes it handed out.
+func newPooledFwdConn(t *testing.T, p *Pool, pod corev1.Pod) (*FwdConn, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	errLocal, errRemote := net.Pipe()
+	t.Cleanup(func() {
+		remote.Close()
+		errRemote.Close()
+	})
+
+	sc := newStubSharedConn(pod)
+	p.fw.conns[sc.key] = append(p.fw.conns[sc.key], sc)
+
+	fc := newFwdConn(p.fw, sc, pod, "80", pipeStream{local}, pipeStream{errLocal})
+	go fc.readLoop()
+	p.out[fc] = poolKey{namespace: pod.Namespace, pod: pod.Name, port: "80"}
+	return fc, remote
+}
+
+func TestPoolReuse(t *testing.T) {
+	fw := newTestForwarder(t)
+	p := fw.NewPool(PoolConfig{MaxIdlePerKey: 1})
+	defer p.Close()
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+	fc, _ := newPooledFwdConn(t, p, pod)
+	extra, _ := newPooledFwdConn(t, p, pod)
+
+	p.Put(fc)
+	p.Put(extra)
+	if stats := p.Stats(); stats.Idle != 1 || stats.Evictions != 1 {
+		t.Errorf("Expected 1 idle connection and 1 eviction, got %+v", stats)
+	}
+	if !isClosedChan(extra.closed) {
+		t.Errorf("Expected the connection that did not fit to be closed")
+	}
+
+	got, err := p.Get(t.Context(), pod, "80")
+	if err != nil || got != fc {
+		t.Fatalf("Expected the idle connection back, got %p (%v)", got, err)
+	}
+	if stats := p.Stats(); stats.Hits != 1 || stats.InUse != 1 {
+		t.Errorf("Expected 1 hit and 1 connection in use, got %+v", stats)
+	}
+}
+
+func TestPoolEvictsUnreadData(t *testing.T) {
+	fw := newTestForwarder(t)
+	p := fw.NewPool(PoolConfig{})
+	defer p.Close()
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+	fc, remote := newPooledFwdConn(t, p, pod)
+
+	// The pod sends a stray response that the client never read.
+	remote.Write([]byte("late"))
+	time.Sleep(20 * time.Millisecond)
+	p.Put(fc)
+	if stats := p.Stats(); stats.Idle != 0 || stats.Evictions != 1 {
+		t.Errorf("Expected the connection to be evicted, got %+v", stats)
+	}
+}
@@ -0,0 +1,111 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	ErrContainerNotFound = fmt.Errorf("container not found")
+)
+
+// PortNotFoundError is returned when a named port is not declared by the pod,
+// or by the chosen container.
+type PortNotFoundError struct {
+	Namespace string
+	Pod       string
+	// Container is empty when every container of the pod was searched.
+	Container string
+	Port      string
+	// Available lists the ports declared by the searched containers.
+	Available []corev1.ContainerPort
+}
+
+func (e *PortNotFoundError) Error() string {
+	where := fmt.Sprintf("pod %s/%s", e.Namespace, e.Pod)
+	if e.Container != "" {
+		where = fmt.Sprintf("container %q of %s", e.Container, where)
+	}
+
+	var available []string
+	for _, p := range e.Available {
+		if p.Name != "" {
+			available = append(available, fmt.Sprintf("%s(%d)", p.Name, p.ContainerPort))
+		} else {
+			available = append(available, strconv.Itoa(int(p.ContainerPort)))
+		}
+	}
+	if len(available) == 0 {
+		return fmt.Sprintf("port %q not found in %s, which declares no ports", e.Port, where)
+	}
+	return fmt.Sprintf("port %q not found in %s, available: %s", e.Port, where, strings.Join(available, ", "))
+}
+
+// ForwardContainer is like Forward, but resolves a named port against the
+// ports of the given container only. An empty container searches them all.
+func (fw *Forwarder) ForwardContainer(ctx context.Context, pod corev1.Pod, container, port string) (*FwdConn, error) {
+	fw.defaultNamespace(&pod)
+	resolved, err := fw.resolvePort(ctx, &pod, container, port)
+	if err != nil {
+		return nil, err
+	}
+	return fw.forward(ctx, pod, resolved)
+}
+
+// resolvePort returns port unchanged if it is numeric. Otherwise it looks the
+// name up in the pod's container ports, fetching the pod first if it is only
+// a name and namespace.
+func (fw *Forwarder) resolvePort(ctx context.Context, pod *corev1.Pod, container, port string) (string, error) {
+	if _, err := strconv.ParseUint(port, 10, 16); err == nil {
+		return port, nil
+	}
+
+	if len(pod.Spec.Containers) == 0 {
+		err := fw.kc.Get().
+			Prefix("api/v1").
+			Namespace(pod.Namespace).
+			Resource("pods").
+			Name(pod.Name).
+			Do(ctx).
+			Into(pod)
+		if err != nil {
+			return "", fmt.Errorf("error getting pod %s/%s to resolve port %q: %w", pod.Namespace, pod.Name, port, err)
+		}
+	}
+
+	notFound := &PortNotFoundError{
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Container: container,
+		Port:      port,
+	}
+	foundContainer := container == ""
+	for _, c := range pod.Spec.Containers {
+		if container != "" && c.Name != container {
+			continue
+		}
+		foundContainer = true
+		for _, p := range c.Ports {
+			if p.Name == port {
+				return strconv.Itoa(int(p.ContainerPort)), nil
+			}
+		}
+		notFound.Available = append(notFound.Available, c.Ports...)
+	}
+	if !foundContainer {
+		return "", fmt.Errorf("%w: %q in pod %s/%s", ErrContainerNotFound, container, pod.Namespace, pod.Name)
+	}
+	return "", notFound
+}
+
+// defaultNamespace puts a pod without a namespace in the Forwarder's default
+// one.
+func (fw *Forwarder) defaultNamespace(pod *corev1.Pod) {
+	if pod.Namespace == "" {
+		pod.Namespace = fw.namespace
+	}
+}
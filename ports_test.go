@@ -0,0 +1,61 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolvePort(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+				{Name: "sidecar", Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9090}}},
+			},
+		},
+	}
+	fw := &Forwarder{}
+
+	testCases := []struct {
+		name      string
+		container string
+		port      string
+		want      string
+		wantErr   bool
+	}{
+		{name: "numeric", port: "80", want: "80"},
+		{name: "named", port: "metrics", want: "9090"},
+		{name: "named in container", container: "app", port: "http", want: "8080"},
+		{name: "named in other container", container: "app", port: "metrics", wantErr: true},
+		{name: "unknown", port: "grpc", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := fw.resolvePort(context.Background(), &pod, tc.container, tc.port)
+			if tc.wantErr {
+				var pnf *PortNotFoundError
+				if !errors.As(err, &pnf) {
+					t.Fatalf("Expected *PortNotFoundError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected port %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	_, err := fw.resolvePort(context.Background(), &pod, "missing", "http")
+	if !errors.Is(err, ErrContainerNotFound) {
+		t.Errorf("Expected ErrContainerNotFound, got %v", err)
+	}
+}
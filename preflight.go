@@ -0,0 +1,94 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ForwardChecked is like Forward, but runs Preflight first so that a pod that
+// cannot be forwarded to is reported without opening any stream.
+func (fw *Forwarder) ForwardChecked(ctx context.Context, pod corev1.Pod, port string) (*FwdConn, error) {
+	pod, resolved, err := fw.Preflight(ctx, pod, port)
+	if err != nil {
+		return nil, err
+	}
+	return fw.forward(ctx, pod, resolved)
+}
+
+// Preflight fetches the pod and checks that it is running and ready, and that
+// one of its containers declares the port, which may be given by number or
+// name. It returns the fetched pod and the numeric port. Pods that are missing,
+// not running or not ready are reported as a *ForwardError, and undeclared
+// ports as a *PortNotFoundError. Note that containers may listen on ports they
+// do not declare, which this check rejects.
+func (fw *Forwarder) Preflight(ctx context.Context, pod corev1.Pod, port string) (corev1.Pod, string, error) {
+	fw.defaultNamespace(&pod)
+	var current corev1.Pod
+	err := fw.kc.Get().
+		Prefix("api/v1").
+		Namespace(pod.Namespace).
+		Resource("pods").
+		Name(pod.Name).
+		Do(ctx).
+		Into(&current)
+	if err != nil {
+		// Status errors from the GET are classified like those of the upgrade.
+		fe := dialError(pod.Namespace, pod.Name, port, fmt.Errorf("error getting pod: %w", err))
+		if fe.Kind == UpgradeFailed {
+			fe.Kind = Unknown
+		}
+		return corev1.Pod{}, "", fe
+	}
+
+	fe := &ForwardError{Kind: PodNotRunning, Namespace: pod.Namespace, Pod: pod.Name, Port: port}
+	switch {
+	case current.DeletionTimestamp != nil:
+		fe.Message = "pod is being deleted"
+		return current, "", fe
+	case current.Status.Phase != corev1.PodRunning:
+		fe.Message = fmt.Sprintf("pod phase is %s", current.Status.Phase)
+		if current.Status.Reason != "" {
+			fe.Message += " (" + current.Status.Reason + ")"
+		}
+		return current, "", fe
+	case !podReady(current):
+		fe.Message = "pod is not ready"
+		for _, c := range current.Status.ContainerStatuses {
+			if !c.Ready {
+				fe.Message += fmt.Sprintf(", container %q is not ready", c.Name)
+			}
+		}
+		return current, "", fe
+	}
+
+	resolved, err := fw.resolvePort(ctx, &current, "", port)
+	if err != nil {
+		return current, "", err
+	}
+	if err := declaresPort(current, resolved, port); err != nil {
+		return current, "", err
+	}
+	return current, resolved, nil
+}
+
+// declaresPort checks that a container of the pod declares the numeric port.
+func declaresPort(pod corev1.Pod, resolved, port string) error {
+	num, err := strconv.Atoi(resolved)
+	if err != nil {
+		return err
+	}
+
+	notFound := &PortNotFoundError{Namespace: pod.Namespace, Pod: pod.Name, Port: port}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if int(p.ContainerPort) == num {
+				return nil
+			}
+		}
+		notFound.Available = append(notFound.Available, c.Ports...)
+	}
+	return notFound
+}
@@ -0,0 +1,70 @@
+package k8sport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func TestPreflight(t *testing.T) {
+	running := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "running"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	pending := *running.DeepCopy()
+	pending.Name = "pending"
+	pending.Status = corev1.PodStatus{Phase: corev1.PodPending}
+
+	pods := map[string]corev1.Pod{"running": running, "pending": pending}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		pod, ok := pods[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		if !ok {
+			k8sporttest.WriteStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(pod)
+	}))
+	defer srv.Close()
+
+	fw, err := NewForwarder(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	stub := func(name string) corev1.Pod {
+		return corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+	}
+
+	_, port, err := fw.Preflight(context.Background(), stub("running"), "http")
+	if err != nil || port != "8080" {
+		t.Errorf("Expected port 8080, got %q (%v)", port, err)
+	}
+
+	if _, _, err := fw.Preflight(context.Background(), stub("running"), "9090"); err == nil {
+		t.Errorf("Expected undeclared port to be rejected")
+	}
+	if _, _, err := fw.Preflight(context.Background(), stub("pending"), "8080"); !errors.Is(err, ErrPodNotRunning) {
+		t.Errorf("Expected ErrPodNotRunning, got %v", err)
+	}
+	if _, _, err := fw.Preflight(context.Background(), stub("missing"), "8080"); !errors.Is(err, ErrPodNotFound) {
+		t.Errorf("Expected ErrPodNotFound, got %v", err)
+	}
+}
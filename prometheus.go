@@ -0,0 +1,178 @@
+package k8sport
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultDialBuckets are the upper bounds, in seconds, of the dial duration
+// histogram buckets of PrometheusMetrics.
+var DefaultDialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// PrometheusMetrics is a Metrics implementation that keeps counters, gauges
+// and histograms labeled by namespace, pod and port. It is a
+// prometheus.Collector, to be registered with a prometheus.Registerer.
+//
+// The following metrics are exported:
+//
+//	k8sport_forwards_opened_total{namespace,pod,port}
+//	k8sport_forwards_failed_total{namespace,port,kind}
+//	k8sport_forwards_active{namespace,pod,port}
+//	k8sport_read_bytes_total{namespace,pod,port}
+//	k8sport_written_bytes_total{namespace,pod,port}
+//	k8sport_stream_errors_total{namespace,pod,port,kind}
+//	k8sport_dial_duration_seconds{namespace,result}
+//
+// So that pods that come and go do not pile up series, the series of a pod's
+// port are deleted once its last forward is closed, and bytes and stream
+// errors reported for it after that are dropped. Failed forwards and dials,
+// which may be all a pod that is gone ever sees, are not labeled by pod.
+type PrometheusMetrics struct {
+	opened, failed *prometheus.CounterVec
+	active         *prometheus.GaugeVec
+	read, written  *prometheus.CounterVec
+	streamErrors   *prometheus.CounterVec
+	dials          *prometheus.HistogramVec
+
+	// mu guards the counts of open forwards, and keeps series from being
+	// recorded while they are deleted.
+	mu    sync.Mutex
+	ports map[portLabels]int
+}
+
+type portLabels struct {
+	namespace, pod, port string
+}
+
+var (
+	_ Metrics              = (*PrometheusMetrics)(nil)
+	_ prometheus.Collector = (*PrometheusMetrics)(nil)
+)
+
+// NewPrometheusMetrics returns a PrometheusMetrics with no recorded values.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	portLabelNames := []string{"namespace", "pod", "port"}
+	return &PrometheusMetrics{
+		opened: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8sport_forwards_opened_total",
+			Help: "Port forwards established.",
+		}, portLabelNames),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8sport_forwards_failed_total",
+			Help: "Port forwards that could not be established, by error kind.",
+		}, []string{"namespace", "port", "kind"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8sport_forwards_active",
+			Help: "Port forwards currently open.",
+		}, portLabelNames),
+		read: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8sport_read_bytes_total",
+			Help: "Bytes read from pods through port forwards.",
+		}, portLabelNames),
+		written: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8sport_written_bytes_total",
+			Help: "Bytes written to pods through port forwards.",
+		}, portLabelNames),
+		streamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8sport_stream_errors_total",
+			Help: "Errors reported on port forward error streams, by error kind.",
+		}, append(portLabelNames, "kind")),
+		dials: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k8sport_dial_duration_seconds",
+			Help:    "Time taken to upgrade connections to pods.",
+			Buckets: DefaultDialBuckets,
+		}, []string{"namespace", "result"}),
+		ports: map[portLabels]int{},
+	}
+}
+
+func (m *PrometheusMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.opened, m.failed, m.active, m.read, m.written, m.streamErrors, m.dials}
+}
+
+// Describe implements prometheus.Collector.
+func (m *PrometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *PrometheusMetrics) DialDone(namespace, pod string, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.dials.WithLabelValues(namespace, result).Observe(d.Seconds())
+}
+
+func (m *PrometheusMetrics) ForwardOpened(namespace, pod, port string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ports[portLabels{namespace, pod, port}]++
+	m.opened.WithLabelValues(namespace, pod, port).Inc()
+	m.active.WithLabelValues(namespace, pod, port).Inc()
+}
+
+func (m *PrometheusMetrics) ForwardFailed(namespace, pod, port string, err error) {
+	kind := Unknown
+	var fe *ForwardError
+	if errors.As(err, &fe) {
+		kind = fe.Kind
+	}
+	m.failed.WithLabelValues(namespace, port, kind.String()).Inc()
+}
+
+func (m *PrometheusMetrics) ForwardClosed(namespace, pod, port string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := portLabels{namespace, pod, port}
+	if m.ports[k] == 0 {
+		return
+	}
+	m.ports[k]--
+	if m.ports[k] > 0 {
+		m.active.WithLabelValues(namespace, pod, port).Dec()
+		return
+	}
+
+	delete(m.ports, k)
+	labels := prometheus.Labels{"namespace": namespace, "pod": pod, "port": port}
+	for _, v := range []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		m.opened, m.active, m.read, m.written, m.streamErrors,
+	} {
+		v.DeletePartialMatch(labels)
+	}
+}
+
+func (m *PrometheusMetrics) BytesRead(namespace, pod, port string, n int) {
+	m.addToOpen(m.read, namespace, pod, port, float64(n))
+}
+
+func (m *PrometheusMetrics) BytesWritten(namespace, pod, port string, n int) {
+	m.addToOpen(m.written, namespace, pod, port, float64(n))
+}
+
+func (m *PrometheusMetrics) StreamError(namespace, pod, port string, kind ErrorKind) {
+	m.addToOpen(m.streamErrors, namespace, pod, port, 1, kind.String())
+}
+
+// addToOpen adds v to the series of a port that has forwards open, followed by
+// the extra label values.
+func (m *PrometheusMetrics) addToOpen(vec *prometheus.CounterVec, namespace, pod, port string, v float64, extra ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ports[portLabels{namespace, pod, port}] == 0 {
+		return
+	}
+	vec.WithLabelValues(append([]string{namespace, pod, port}, extra...)...).Add(v)
+}
@@ -0,0 +1,136 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+// gatherSeries gathers the metrics registered with reg as series such as
+// `name{label="value",...}`, mapped to their value. Histograms are mapped to
+// their sample count.
+func gatherSeries(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	out := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+`"`+l.GetValue()+`"`)
+			}
+			name := mf.GetName() + "{" + strings.Join(labels, ",") + "}"
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				out[name] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				out[name] = m.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				out[name] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return out
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatalf("Failed to register metrics: %v", err)
+	}
+
+	m.DialDone("ns", "mypod", 30*time.Millisecond, nil)
+	m.ForwardOpened("ns", "mypod", "80")
+	m.ForwardOpened("ns", "mypod", "80")
+	m.ForwardOpened("ns", "mypod", "81")
+	m.ForwardClosed("ns", "mypod", "80")
+	m.ForwardFailed("ns", "gone", "80", &ForwardError{Kind: PodNotFound})
+	m.ForwardFailed("ns", "gone", "80", errors.New("unclassified"))
+	m.BytesRead("ns", "mypod", "80", 5)
+	m.BytesWritten("ns", "mypod", "80", 7)
+	m.StreamError("ns", "mypod", "81", PortRefused)
+	// Nothing is open to the pod, so this is dropped.
+	m.BytesRead("ns", "gone", "80", 3)
+
+	got := gatherSeries(t, reg)
+	for series, want := range map[string]float64{
+		`k8sport_forwards_opened_total{namespace="ns",pod="mypod",port="80"}`:                   2,
+		`k8sport_forwards_active{namespace="ns",pod="mypod",port="80"}`:                         1,
+		`k8sport_forwards_failed_total{kind="pod not found",namespace="ns",port="80"}`:          1,
+		`k8sport_forwards_failed_total{kind="unknown error",namespace="ns",port="80"}`:          1,
+		`k8sport_read_bytes_total{namespace="ns",pod="mypod",port="80"}`:                        5,
+		`k8sport_written_bytes_total{namespace="ns",pod="mypod",port="80"}`:                     7,
+		`k8sport_stream_errors_total{kind="port refused",namespace="ns",pod="mypod",port="81"}`: 1,
+		`k8sport_dial_duration_seconds{namespace="ns",result="success"}`:                        1,
+	} {
+		if v, ok := got[series]; !ok || v != want {
+			t.Errorf("Expected %s to be %v, got %v (present: %t)", series, want, v, ok)
+		}
+	}
+	if _, ok := got[`k8sport_read_bytes_total{namespace="ns",pod="gone",port="80"}`]; ok {
+		t.Errorf("Expected bytes read from a pod without open forwards to be dropped")
+	}
+
+	// Closing the last forward to a port deletes its series.
+	m.ForwardClosed("ns", "mypod", "80")
+	got = gatherSeries(t, reg)
+	for series := range got {
+		if strings.Contains(series, `port="80"`) && strings.Contains(series, `pod="mypod"`) {
+			t.Errorf("Expected %s to be deleted", series)
+		}
+	}
+	if _, ok := got[`k8sport_forwards_active{namespace="ns",pod="mypod",port="81"}`]; !ok {
+		t.Errorf("Expected the series of the port still open to be kept")
+	}
+
+	m.ForwardClosed("ns", "mypod", "81")
+	for series := range gatherSeries(t, reg) {
+		if strings.Contains(series, `pod="mypod"`) {
+			t.Errorf("Expected %s to be deleted", series)
+		}
+	}
+}
+
+func TestPrometheusMetricsMissingPod(t *testing.T) {
+	srv := k8sporttest.NewServer()
+	defer srv.Close()
+
+	m := NewPrometheusMetrics()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m)
+	fw, err := NewForwarder(srv.Config(), WithMetrics(m))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "gone"}}
+	if _, err := fw.Forward(context.Background(), pod, "80"); !errors.Is(err, ErrPodNotFound) {
+		t.Fatalf("Expected ErrPodNotFound, got %v", err)
+	}
+
+	got := gatherSeries(t, reg)
+	for series := range got {
+		if strings.Contains(series, `pod="gone"`) {
+			t.Errorf("Expected no series for a pod that was never forwarded to, got %s", series)
+		}
+	}
+	if got[`k8sport_forwards_failed_total{kind="pod not found",namespace="ns",port="80"}`] != 1 {
+		t.Errorf("Expected the failed forward to be counted, got %v", got)
+	}
+	if got[`k8sport_dial_duration_seconds{namespace="ns",result="error"}`] != 1 {
+		t.Errorf("Expected the failed dial to be observed, got %v", got)
+	}
+}
@@ -0,0 +1,240 @@
+package k8sport
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+// newProxyTestServer returns a server with a pod whose named port http is
+// served by k8sporttest.Echo, so that forwarding to it makes both a REST
+// request, to resolve the port, and an upgrade.
+func newProxyTestServer(t *testing.T) *k8sporttest.Server {
+	t.Helper()
+	srv := k8sporttest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddPod(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 80}}}},
+		},
+	})
+	srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+	return srv
+}
+
+// forwardEcho forwards to the http port of the pod served by
+// newProxyTestServer and checks that the connection works.
+func forwardEcho(t *testing.T, fw *Forwarder) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fc, err := fw.Forward(ctx, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}, "http")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	defer fc.Close()
+
+	if _, err := fc.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := fc.CloseWrite(); err != nil {
+		t.Fatalf("Failed to close writing side: %v", err)
+	}
+	if b, err := io.ReadAll(fc); err != nil || string(b) != "hello" {
+		t.Errorf("Expected echo of hello, got %q (%v)", b, err)
+	}
+}
+
+// recordingConn records what is written to it.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written *bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestProxyDialer(t *testing.T) {
+	srv := newProxyTestServer(t)
+
+	var (
+		mu      sync.Mutex
+		written []*bytes.Buffer
+	)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		mu.Lock()
+		written = append(written, buf)
+		mu.Unlock()
+		return &recordingConn{Conn: c, written: buf}, nil
+	}
+
+	fw, err := NewForwarder(srv.Config(), WithProxyDialer(dial))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	forwardEcho(t, fw)
+
+	mu.Lock()
+	var all strings.Builder
+	for _, buf := range written {
+		all.Write(buf.Bytes())
+	}
+	mu.Unlock()
+	for _, want := range []string{
+		"GET /api/v1/namespaces/ns/pods/mypod ",
+		"POST /api/v1/namespaces/ns/pods/mypod/portforward ",
+	} {
+		if !strings.Contains(all.String(), want) {
+			t.Errorf("Expected %q to be sent through the dialer", want)
+		}
+	}
+}
+
+func TestProxyConnect(t *testing.T) {
+	srv := newProxyTestServer(t)
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		if r.Method != http.MethodConnect {
+			// Plain HTTP requests are sent to the proxy in absolute form.
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, client)
+			upstream.Close()
+		}()
+		io.Copy(client, upstream)
+		client.Close()
+	}))
+	defer proxy.Close()
+	defer proxy.CloseClientConnections()
+
+	u, _ := url.Parse(proxy.URL)
+	fw, err := NewForwarder(srv.Config(), WithProxy(u))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	forwardEcho(t, fw)
+
+	mu.Lock()
+	defer mu.Unlock()
+	all := strings.Join(requests, "\n")
+	for _, want := range []string{
+		"GET /api/v1/namespaces/ns/pods/mypod",
+		"CONNECT ",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Expected %q to go through the proxy, got:\n%s", want, all)
+		}
+	}
+}
+
+func TestProxyDialerVerifiesTLS(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		auth []string
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	// The failed handshake is expected.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	dial := (&net.Dialer{}).DialContext
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+
+	// The self-signed certificate of the server is not trusted without its CA.
+	fw, err := NewForwarder(&rest.Config{Host: srv.URL, BearerToken: "secret-token"}, WithProxyDialer(dial))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	if _, err := fw.Forward(context.Background(), pod, "80"); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Expected a certificate error, got %v", err)
+	}
+	mu.Lock()
+	if len(auth) != 0 {
+		t.Errorf("Expected no request to reach the untrusted server, got %d", len(auth))
+	}
+	mu.Unlock()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	fw, err = NewForwarder(&rest.Config{
+		Host:            srv.URL,
+		BearerToken:     "secret-token",
+		TLSClientConfig: rest.TLSClientConfig{CAData: ca},
+	}, WithProxyDialer(dial))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	if _, err := fw.Forward(context.Background(), pod, "80"); err == nil {
+		t.Errorf("Expected the rejected upgrade to fail")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(auth) != 1 || auth[0] != "Bearer secret-token" {
+		t.Errorf("Expected one upgrade with the bearer token once the CA is trusted, got %q", auth)
+	}
+}
@@ -0,0 +1,280 @@
+package k8sport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var (
+	ErrReconnectFailed = fmt.Errorf("reconnect failed")
+)
+
+// DefaultReconnectBackoff is used by a Reconnector whose config leaves Backoff
+// unset.
+var DefaultReconnectBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    10,
+	Cap:      30 * time.Second,
+}
+
+// ReconnectConfig configures a Reconnector.
+type ReconnectConfig struct {
+	// Backoff is the delay between failed attempts to forward to a pod. It
+	// defaults to DefaultReconnectBackoff.
+	Backoff *wait.Backoff
+
+	// MaxAttempts limits the attempts a single Forward call makes. Zero means
+	// no limit other than the caller's context.
+	MaxAttempts int
+
+	// OnReconnect, if set, is called each time the Reconnector looks for a new
+	// pod after losing the previous one, whether or not it found one.
+	OnReconnect func(ReconnectEvent)
+}
+
+// ReconnectEvent describes an attempt to move to a new pod.
+type ReconnectEvent struct {
+	Target Target
+	// Previous is the pod that went away or could no longer be forwarded to.
+	Previous corev1.Pod
+	// Pod is the newly chosen pod, unset if Err is set.
+	Pod corev1.Pod
+	// Attempt counts the attempts made by the Forward call, starting at 1.
+	Attempt int
+	Err     error
+}
+
+// Reconnector hands out connections to a target whose pods may come and go. It
+// keeps forwarding to the same pod while that pod is ready, watches it, and
+// once it is deleted, stops being ready or forwarding to it fails because it
+// is gone, not running or its streams were reset, resolves the target to a
+// new ready pod. Connections that were already handed out are not migrated;
+// they fail as usual and callers get working ones from the next Forward.
+type Reconnector struct {
+	fw     *Forwarder
+	target Target
+	port   string
+	cfg    ReconnectConfig
+
+	// ctx bounds the pod watches and is cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	pod       corev1.Pod
+	podPort   string
+	resolved  bool
+	previous  corev1.Pod
+	stopWatch context.CancelFunc
+}
+
+// Reconnecting returns a Reconnector forwarding to port on the target. For
+// services the port is a service port. Close must be called to stop watching
+// the current pod.
+func (fw *Forwarder) Reconnecting(t Target, port string, cfg ReconnectConfig) *Reconnector {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reconnector{
+		fw:     fw,
+		target: t,
+		port:   port,
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Pod returns the pod connections are currently forwarded to, if any.
+func (r *Reconnector) Pod() (corev1.Pod, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pod, r.resolved
+}
+
+// Forward returns a new connection to the current pod, moving to a new one
+// with backoff if needed.
+func (r *Reconnector) Forward(ctx context.Context) (*FwdConn, error) {
+	backoff := DefaultReconnectBackoff
+	if r.cfg.Backoff != nil {
+		backoff = *r.cfg.Backoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		pod, port, err := r.current(ctx, attempt)
+		if err == nil {
+			var conn *FwdConn
+			conn, err = r.fw.Forward(ctx, pod, port)
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() == nil && podLost(err) {
+				r.invalidate(pod)
+			}
+		}
+
+		if r.cfg.MaxAttempts > 0 && attempt >= r.cfg.MaxAttempts {
+			return nil, fmt.Errorf("%w: %s after %d attempts: %w", ErrReconnectFailed, r.target, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s: %w", ErrReconnectFailed, r.target, ctx.Err())
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// DialContext ignores the address and forwards to the Reconnector's target, so
+// that it can be given to clients that expect a dial function.
+func (r *Reconnector) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return r.Forward(ctx)
+}
+
+// Close stops watching the current pod. Connections already handed out are
+// not affected.
+func (r *Reconnector) Close() error {
+	r.cancel()
+	return nil
+}
+
+// current returns the pod to forward to, resolving the target if the last
+// one was lost.
+func (r *Reconnector) current(ctx context.Context, attempt int) (corev1.Pod, string, error) {
+	r.mu.Lock()
+	if r.resolved {
+		defer r.mu.Unlock()
+		return r.pod, r.podPort, nil
+	}
+	r.mu.Unlock()
+
+	pod, port, err := r.fw.ResolveTarget(ctx, r.target, r.port)
+
+	r.mu.Lock()
+	previous := r.previous
+	reconnect := previous.Name != ""
+	if err == nil && !r.resolved {
+		r.pod, r.podPort, r.resolved = pod, port, true
+		watchCtx, cancel := context.WithCancel(r.ctx)
+		r.stopWatch = cancel
+		go r.watch(watchCtx, pod)
+	}
+	pod, port = r.pod, r.podPort
+	r.mu.Unlock()
+
+	if reconnect && r.cfg.OnReconnect != nil {
+		r.cfg.OnReconnect(ReconnectEvent{
+			Target:   r.target,
+			Previous: previous,
+			Pod:      pod,
+			Attempt:  attempt,
+			Err:      err,
+		})
+	}
+	return pod, port, err
+}
+
+// podLost reports whether err from forwarding to a pod means that the pod went
+// away, rather than that the forward itself failed.
+func podLost(err error) bool {
+	return errors.Is(err, ErrPodNotFound) || errors.Is(err, ErrPodNotRunning) || errors.Is(err, ErrStreamReset)
+}
+
+// invalidate forgets the pod so that the next Forward resolves the target
+// again.
+func (r *Reconnector) invalidate(pod corev1.Pod) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.resolved || r.pod.Name != pod.Name {
+		return
+	}
+	r.previous = r.pod
+	r.pod, r.podPort, r.resolved = corev1.Pod{}, "", false
+	if r.stopWatch != nil {
+		r.stopWatch()
+		r.stopWatch = nil
+	}
+}
+
+// watch invalidates the pod once it is deleted or stops being ready. Watches
+// that end are restarted from the last seen resource version.
+func (r *Reconnector) watch(ctx context.Context, pod corev1.Pod) {
+	var resourceVersion string
+	for ctx.Err() == nil {
+		gone, rv, err := r.watchOnce(ctx, pod, resourceVersion)
+		if gone {
+			r.invalidate(pod)
+			return
+		}
+		resourceVersion = rv
+		if err != nil {
+			// The resource version may have expired, so start over from the
+			// current state after a short pause.
+			resourceVersion = ""
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// watchOnce streams watch events for the pod until the watch ends, reporting
+// whether the pod went away and the last resource version seen.
+func (r *Reconnector) watchOnce(ctx context.Context, pod corev1.Pod, resourceVersion string) (bool, string, error) {
+	req := r.fw.kc.Get().
+		Prefix("api/v1").
+		Namespace(pod.Namespace).
+		Resource("pods").
+		Param("watch", "true").
+		Param("fieldSelector", "metadata.name="+pod.Name)
+	if resourceVersion != "" {
+		req = req.Param("resourceVersion", resourceVersion)
+	}
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		return false, resourceVersion, fmt.Errorf("error watching pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	defer stream.Close()
+
+	dec := json.NewDecoder(stream)
+	for {
+		var ev metav1.WatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				// The apiserver ended the watch; it is resumed by the caller.
+				return false, resourceVersion, nil
+			}
+			return false, resourceVersion, err
+		}
+
+		switch watch.EventType(ev.Type) {
+		case watch.Error:
+			return false, resourceVersion, fmt.Errorf("error watching pod %s/%s: %s", pod.Namespace, pod.Name, ev.Object.Raw)
+		case watch.Bookmark:
+			continue
+		}
+
+		var p corev1.Pod
+		if err := json.Unmarshal(ev.Object.Raw, &p); err != nil {
+			return false, resourceVersion, fmt.Errorf("error decoding pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+		resourceVersion = p.ResourceVersion
+
+		// A pod recreated under the same name is a different pod.
+		replaced := pod.UID != "" && p.UID != pod.UID
+		if watch.EventType(ev.Type) == watch.Deleted || replaced || !podReady(p) {
+			return true, resourceVersion, nil
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package k8sport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func readyPod(name, uid, rv string) corev1.Pod {
+	return corev1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns", Name: name, UID: types.UID(uid), ResourceVersion: rv,
+			Labels: map[string]string{"app": "web"},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func watchEvent(t *testing.T, typ watch.EventType, obj any) metav1.WatchEvent {
+	t.Helper()
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("Failed to encode %v: %v", obj, err)
+	}
+	return metav1.WatchEvent{Type: string(typ), Object: runtime.RawExtension{Raw: raw}}
+}
+
+func TestReconnectorWatch(t *testing.T) {
+	notReady := readyPod("web-1", "u1", "3")
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+
+	testCases := []struct {
+		name     string
+		events   []metav1.WatchEvent
+		wantGone bool
+		wantRV   string
+		wantErr  bool
+	}{
+		{
+			name: "ready",
+			events: []metav1.WatchEvent{
+				watchEvent(t, watch.Added, readyPod("web-1", "u1", "1")),
+				watchEvent(t, watch.Bookmark, readyPod("", "", "5")),
+				watchEvent(t, watch.Modified, readyPod("web-1", "u1", "2")),
+			},
+			wantRV: "2",
+		},
+		{
+			name:     "deleted",
+			events:   []metav1.WatchEvent{watchEvent(t, watch.Deleted, readyPod("web-1", "u1", "3"))},
+			wantGone: true,
+			wantRV:   "3",
+		},
+		{
+			name:     "not ready",
+			events:   []metav1.WatchEvent{watchEvent(t, watch.Modified, notReady)},
+			wantGone: true,
+			wantRV:   "3",
+		},
+		{
+			name:     "replaced",
+			events:   []metav1.WatchEvent{watchEvent(t, watch.Added, readyPod("web-1", "u2", "4"))},
+			wantGone: true,
+			wantRV:   "4",
+		},
+		{
+			name: "error",
+			events: []metav1.WatchEvent{watchEvent(t, watch.Error, metav1.Status{
+				Status: metav1.StatusFailure, Reason: metav1.StatusReasonExpired, Code: http.StatusGone,
+			})},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var query string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				w.Header().Set("Content-Type", "application/json")
+				enc := json.NewEncoder(w)
+				for _, ev := range tc.events {
+					enc.Encode(ev)
+				}
+			}))
+			defer srv.Close()
+			fw, err := NewForwarder(&rest.Config{Host: srv.URL})
+			if err != nil {
+				t.Fatalf("Failed to create Forwarder: %v", err)
+			}
+
+			r := fw.Reconnecting(Target{Kind: KindSelector, Namespace: "ns", Selector: "app=web"}, "80", ReconnectConfig{})
+			defer r.Close()
+			gone, rv, err := r.watchOnce(context.Background(), readyPod("web-1", "u1", "1"), "1")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if gone != tc.wantGone || rv != tc.wantRV {
+				t.Errorf("Expected gone=%v at %s, got gone=%v at %s", tc.wantGone, tc.wantRV, gone, rv)
+			}
+			if want := "fieldSelector=metadata.name%3Dweb-1&resourceVersion=1&watch=true"; query != want {
+				t.Errorf("Expected query %s, got %s", want, query)
+			}
+		})
+	}
+}
+
+// reconnectServer lists a new pod, web-1, web-2 and so on, every time the
+// pods are listed, holds watches open until the client goes away, and answers
+// every upgrade with code and reason.
+type reconnectServer struct {
+	mu     sync.Mutex
+	lists  int
+	code   int
+	reason metav1.StatusReason
+}
+
+func (s *reconnectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPost:
+		s.mu.Lock()
+		code, reason := s.code, s.reason
+		s.mu.Unlock()
+		k8sporttest.WriteStatus(w, code, reason, "")
+	case r.URL.Query().Get("watch") == "true":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	default:
+		s.mu.Lock()
+		s.lists++
+		pod := readyPod(fmt.Sprintf("web-%d", s.lists), fmt.Sprintf("u%d", s.lists), "1")
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(corev1.PodList{
+			TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+			Items:    []corev1.Pod{pod},
+		})
+	}
+}
+
+func TestReconnectorForward(t *testing.T) {
+	s := &reconnectServer{code: http.StatusNotFound, reason: metav1.StatusReasonNotFound}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	fw, err := NewForwarder(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	target := Target{Kind: KindSelector, Namespace: "ns", Selector: "app=web"}
+	backoff := &wait.Backoff{Duration: time.Millisecond, Steps: 10}
+
+	// A pod that is not found is given up on, and every attempt moves on to
+	// the next one.
+	var events []ReconnectEvent
+	r := fw.Reconnecting(target, "80", ReconnectConfig{
+		Backoff:     backoff,
+		MaxAttempts: 3,
+		OnReconnect: func(ev ReconnectEvent) { events = append(events, ev) },
+	})
+	defer r.Close()
+	_, err = r.Forward(context.Background())
+	if !errors.Is(err, ErrReconnectFailed) || !errors.Is(err, ErrPodNotFound) {
+		t.Errorf("Expected ErrReconnectFailed wrapping ErrPodNotFound, got %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected a reconnect on each of the 2 later attempts, got %d", len(events))
+	}
+	for i, ev := range events {
+		if ev.Attempt != i+2 || ev.Previous.Name != fmt.Sprintf("web-%d", i+1) || ev.Pod.Name != fmt.Sprintf("web-%d", i+2) || ev.Err != nil {
+			t.Errorf("Expected attempt %d to move from web-%d to web-%d, got %+v", i+2, i+1, i+2, ev)
+		}
+	}
+
+	// Other failures, including the caller's own context ending, keep the
+	// pod.
+	s.mu.Lock()
+	s.code, s.reason = http.StatusForbidden, metav1.StatusReasonForbidden
+	s.mu.Unlock()
+	events = nil
+	r = fw.Reconnecting(target, "80", ReconnectConfig{
+		Backoff:     backoff,
+		MaxAttempts: 2,
+		OnReconnect: func(ev ReconnectEvent) { events = append(events, ev) },
+	})
+	defer r.Close()
+	if _, err := r.Forward(context.Background()); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected ErrForbidden, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Forward(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if pod, ok := r.Pod(); !ok || len(events) != 0 {
+		t.Errorf("Expected to stay on the first pod, got %s (resolved %v) after %d reconnects", pod.Name, ok, len(events))
+	}
+}
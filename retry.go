@@ -0,0 +1,166 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy controls how a Forwarder retries failures to dial the apiserver
+// and to create streams. Zero fields take their values from
+// DefaultRetryPolicy; negative ones turn off jitter and the time limit.
+type RetryPolicy struct {
+	// InitialInterval is the delay before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval caps the delay between retries.
+	MaxInterval time.Duration
+	// Multiplier grows the delay after every retry.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of it, in either
+	// direction. A negative Jitter keeps the delays as they are.
+	Jitter float64
+	// MaxElapsedTime stops retrying once a retry would start this long after
+	// the first attempt. A negative MaxElapsedTime retries until the context
+	// ends.
+	MaxElapsedTime time.Duration
+	// Retryable reports whether an error is worth retrying. It defaults to
+	// IsRetryable.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is the policy WithRetryPolicy fills unset fields from.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     10 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+	MaxElapsedTime:  time.Minute,
+	Retryable:       IsRetryable,
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = DefaultRetryPolicy.InitialInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = DefaultRetryPolicy.MaxInterval
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = DefaultRetryPolicy.Jitter
+	case p.Jitter < 0:
+		p.Jitter = 0
+	}
+	if p.MaxElapsedTime == 0 {
+		p.MaxElapsedTime = DefaultRetryPolicy.MaxElapsedTime
+	}
+	if p.Retryable == nil {
+		p.Retryable = DefaultRetryPolicy.Retryable
+	}
+	return p
+}
+
+// delay returns the jittered wait for the given interval, stretched to the
+// server's Retry-After hint if the error carries a longer one.
+func (p RetryPolicy) delay(interval time.Duration, err error) time.Duration {
+	d := time.Duration(float64(interval) * (1 + p.Jitter*(2*rand.Float64()-1)))
+
+	var fe *ForwardError
+	if errors.As(err, &fe) && fe.RetryAfter > d {
+		d = fe.RetryAfter
+	}
+	return d
+}
+
+// withRetry runs op until it succeeds, fails with an error the policy does
+// not consider retryable, runs out of time or ctx ends.
+func (fw *Forwarder) withRetry(ctx context.Context, op func() error) error {
+	if fw.retry == nil {
+		return op()
+	}
+	p := fw.retry.withDefaults()
+
+	start := time.Now()
+	interval := p.InitialInterval
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !p.Retryable(err) {
+			return err
+		}
+
+		d := p.delay(interval, err)
+		if p.MaxElapsedTime > 0 && time.Since(start)+d > p.MaxElapsedTime {
+			return err
+		}
+
+		fw.log.DebugContext(ctx, "retrying forward", "attempt", attempt, "delay", d, "err", err)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("delay", d.String()),
+			attribute.String("error", err.Error()),
+		))
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%w, last error: %w", ctx.Err(), err)
+		case <-t.C:
+		}
+
+		interval = min(time.Duration(float64(interval)*p.Multiplier), p.MaxInterval)
+	}
+}
+
+// upgradeError carries the Retry-After header of a failed upgrade response
+// alongside the error.
+type upgradeError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *upgradeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upgradeError) Unwrap() error {
+	return e.err
+}
+
+// retryAfterRecorder passes requests through to the transport and remembers
+// the Retry-After header of a response that did not switch protocols.
+type retryAfterRecorder struct {
+	rt         http.RoundTripper
+	retryAfter time.Duration
+}
+
+func (r *retryAfterRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.rt.RoundTrip(req)
+	if err == nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		r.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, err
+}
+
+// parseRetryAfter parses either form of the Retry-After header.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package k8sport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestWithRetry(t *testing.T) {
+	fw, err := NewForwarder(nil,
+		WithRESTClient(&rest.RESTClient{}),
+		WithRoundTripper(http.DefaultTransport, nil),
+		WithRetryPolicy(RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: 2 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	attempts := 0
+	err = fw.withRetry(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return &ForwardError{Kind: Unavailable}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("Expected success after 3 attempts, got %d (%v)", attempts, err)
+	}
+
+	attempts = 0
+	err = fw.withRetry(context.Background(), func() error {
+		attempts++
+		return &ForwardError{Kind: Forbidden}
+	})
+	if !errors.Is(err, ErrForbidden) || attempts != 1 {
+		t.Errorf("Expected ErrForbidden without retrying, got %d attempts (%v)", attempts, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = fw.withRetry(ctx, func() error {
+		return &ForwardError{Kind: StreamReset}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrStreamReset) {
+		t.Errorf("Expected deadline exceeded wrapping ErrStreamReset, got %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{}.withDefaults()
+
+	d := p.delay(time.Second, &ForwardError{Kind: Unavailable})
+	if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+		t.Errorf("Expected jittered delay around 1s, got %v", d)
+	}
+	if d := p.delay(time.Second, &ForwardError{Kind: Unavailable, RetryAfter: 5 * time.Second}); d != 5*time.Second {
+		t.Errorf("Expected Retry-After to win, got %v", d)
+	}
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("Expected 3s, got %v", d)
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	p := RetryPolicy{}.withDefaults()
+	if p.MaxElapsedTime != DefaultRetryPolicy.MaxElapsedTime || p.Jitter != DefaultRetryPolicy.Jitter {
+		t.Errorf("Expected the defaults for zero fields, got %+v", p)
+	}
+
+	p = RetryPolicy{Jitter: -1, MaxElapsedTime: -1}.withDefaults()
+	if p.Jitter != 0 {
+		t.Errorf("Expected a negative Jitter to turn jitter off, got %v", p.Jitter)
+	}
+	for range 10 {
+		if d := p.delay(time.Second, nil); d != time.Second {
+			t.Fatalf("Expected an unjittered delay of 1s, got %v", d)
+		}
+	}
+
+	fw, err := NewForwarder(nil,
+		WithRESTClient(&rest.RESTClient{}),
+		WithRoundTripper(http.DefaultTransport, nil),
+		WithRetryPolicy(RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, MaxElapsedTime: -1}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = fw.withRetry(ctx, func() error {
+		return &ForwardError{Kind: Unavailable}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a negative MaxElapsedTime to retry until the context ends, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	ErrServicePortNotFound = fmt.Errorf("service port not found")
+	ErrNoReadyEndpoints    = fmt.Errorf("no ready endpoints")
+)
+
+// ForwardService establishes a port forwarding connection to a ready pod
+// backing the named service, the way `kubectl port-forward svc/name` does. The
+// port is the service port, given by number or name, and is translated to the
+// pod's target port using the service's EndpointSlices, so named target ports
+// are resolved as well.
+func (fw *Forwarder) ForwardService(ctx context.Context, namespace, name, port string) (*FwdConn, error) {
+	return fw.ForwardTarget(ctx, Target{Kind: KindService, Namespace: namespace, Name: name}, port)
+}
+
+// resolveService picks a ready endpoint of the service using the target's
+// policy and returns its pod along with the pod port that the service port
+// maps to.
+func (fw *Forwarder) resolveService(ctx context.Context, t Target, port string) (corev1.Pod, string, error) {
+	namespace, name := t.Namespace, t.Name
+
+	var svc corev1.Service
+	err := fw.kc.Get().
+		Prefix("api/v1").
+		Namespace(namespace).
+		Resource("services").
+		Name(name).
+		Do(ctx).
+		Into(&svc)
+	if err != nil {
+		return corev1.Pod{}, "", fmt.Errorf("error getting service %s/%s: %w", namespace, name, err)
+	}
+
+	svcPort, err := findServicePort(svc, port)
+	if err != nil {
+		return corev1.Pod{}, "", err
+	}
+
+	var slices discoveryv1.EndpointSliceList
+	err = fw.kc.Get().
+		Prefix("apis/discovery.k8s.io/v1").
+		Namespace(namespace).
+		Resource("endpointslices").
+		Param("labelSelector", discoveryv1.LabelServiceName+"="+name).
+		Do(ctx).
+		Into(&slices)
+	if err != nil {
+		return corev1.Pod{}, "", fmt.Errorf("error listing endpointslices for service %s/%s: %w", namespace, name, err)
+	}
+
+	// Endpoints of a service port may be spread over several slices, and
+	// every slice lists the port, so the pod port is taken per slice.
+	var (
+		ready    []corev1.Pod
+		podPorts = map[string]int32{}
+	)
+	for _, slice := range slices.Items {
+		podPort, ok := endpointPort(slice, svcPort)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if !endpointReady(ep) || ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" {
+				continue
+			}
+			if _, seen := podPorts[ep.TargetRef.Name]; seen {
+				continue
+			}
+			podPorts[ep.TargetRef.Name] = podPort
+			ready = append(ready, corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: namespace,
+					Name:      ep.TargetRef.Name,
+				},
+			})
+		}
+	}
+	if len(ready) == 0 {
+		return corev1.Pod{}, "", fmt.Errorf("%w: service %s/%s port %s", ErrNoReadyEndpoints, namespace, name, port)
+	}
+
+	pod := fw.pick(t, ready)
+	return pod, strconv.Itoa(int(podPorts[pod.Name])), nil
+}
+
+// findServicePort returns the service port matching port by number or name.
+func findServicePort(svc corev1.Service, port string) (corev1.ServicePort, error) {
+	num, numErr := strconv.Atoi(port)
+	for _, sp := range svc.Spec.Ports {
+		if (numErr == nil && int(sp.Port) == num) || sp.Name == port {
+			return sp, nil
+		}
+	}
+
+	var available []string
+	for _, sp := range svc.Spec.Ports {
+		if sp.Name != "" {
+			available = append(available, fmt.Sprintf("%s(%d)", sp.Name, sp.Port))
+		} else {
+			available = append(available, strconv.Itoa(int(sp.Port)))
+		}
+	}
+	return corev1.ServicePort{}, fmt.Errorf("%w: %q on service %s/%s, available: %v", ErrServicePortNotFound, port, svc.Namespace, svc.Name, available)
+}
+
+// endpointPort returns the pod port the slice lists for the service port.
+// EndpointSlice ports carry the service port's name and the resolved target
+// port number.
+func endpointPort(slice discoveryv1.EndpointSlice, sp corev1.ServicePort) (int32, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil || p.Name == nil || *p.Name != sp.Name {
+			continue
+		}
+		if p.Protocol != nil && sp.Protocol != "" && *p.Protocol != sp.Protocol {
+			continue
+		}
+		return *p.Port, true
+	}
+	return 0, false
+}
+
+// endpointReady treats an unknown ready condition as ready, as the
+// EndpointSlice API recommends.
+func endpointReady(ep discoveryv1.Endpoint) bool {
+	return ep.Conditions.Ready == nil || *ep.Conditions.Ready
+}
@@ -0,0 +1,143 @@
+package k8sport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/ptr"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func TestResolveService(t *testing.T) {
+	services := map[string]corev1.Service{
+		"web": {
+			TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "web"},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("web"), Protocol: corev1.ProtocolTCP},
+				{Name: "metrics", Port: 9100, TargetPort: intstr.FromInt32(9090), Protocol: corev1.ProtocolTCP},
+			}},
+		},
+		"down": {
+			TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "down"},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Port: 80, TargetPort: intstr.FromInt32(8080), Protocol: corev1.ProtocolTCP},
+			}},
+		},
+	}
+	endpoint := func(pod string, ready *bool) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: ready},
+			TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "ns", Name: pod},
+		}
+	}
+	slicePort := func(name string, port int32) discoveryv1.EndpointPort {
+		return discoveryv1.EndpointPort{Name: ptr.To(name), Port: ptr.To(port), Protocol: ptr.To(corev1.ProtocolTCP)}
+	}
+	// The named target port "web" is resolved to 8080 in the slices, as the
+	// EndpointSlice controller does.
+	slices := map[string][]discoveryv1.EndpointSlice{
+		"web": {
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-1"},
+				Ports:      []discoveryv1.EndpointPort{slicePort("http", 8080)},
+				Endpoints:  []discoveryv1.Endpoint{endpoint("web-a", ptr.To(false))},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-2"},
+				Ports:      []discoveryv1.EndpointPort{slicePort("http", 8080)},
+				Endpoints:  []discoveryv1.Endpoint{endpoint("web-b", ptr.To(true)), endpoint("web-c", nil)},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-3"},
+				Ports:      []discoveryv1.EndpointPort{slicePort("metrics", 9090)},
+				Endpoints:  []discoveryv1.Endpoint{endpoint("web-d", nil)},
+			},
+		},
+		"down": {
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "down-1"},
+				Ports:      []discoveryv1.EndpointPort{slicePort("", 8080)},
+				Endpoints:  []discoveryv1.Endpoint{endpoint("down-a", ptr.To(false))},
+			},
+		},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/ns/services/"):
+			svc, ok := services[strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/ns/services/")]
+			if !ok {
+				k8sporttest.WriteStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "")
+				return
+			}
+			json.NewEncoder(w).Encode(svc)
+		case r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices":
+			name := strings.TrimPrefix(r.URL.Query().Get("labelSelector"), discoveryv1.LabelServiceName+"=")
+			json.NewEncoder(w).Encode(discoveryv1.EndpointSliceList{
+				TypeMeta: metav1.TypeMeta{Kind: "EndpointSliceList", APIVersion: "discovery.k8s.io/v1"},
+				Items:    slices[name],
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	fw, err := NewForwarder(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		service  string
+		port     string
+		wantPod  string
+		wantPort string
+		wantErr  error
+	}{
+		{name: "port number to named target port", service: "web", port: "80", wantPod: "web-b", wantPort: "8080"},
+		{name: "port name to named target port", service: "web", port: "http", wantPod: "web-b", wantPort: "8080"},
+		{name: "port number to target port number", service: "web", port: "9100", wantPod: "web-d", wantPort: "9090"},
+		{name: "port name to target port number", service: "web", port: "metrics", wantPod: "web-d", wantPort: "9090"},
+		{name: "unknown port", service: "web", port: "443", wantErr: ErrServicePortNotFound},
+		{name: "no ready endpoints", service: "down", port: "80", wantErr: ErrNoReadyEndpoints},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pod, port, err := fw.resolveService(context.Background(), Target{Kind: KindService, Namespace: "ns", Name: tt.service}, tt.port)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve service: %v", err)
+			}
+			if pod.Namespace != "ns" || pod.Name != tt.wantPod || port != tt.wantPort {
+				t.Errorf("Expected ns/%s:%s, got %s/%s:%s", tt.wantPod, tt.wantPort, pod.Namespace, pod.Name, port)
+			}
+		})
+	}
+
+	_, _, err = fw.resolveService(context.Background(), Target{Kind: KindService, Namespace: "ns", Name: "missing"}, "80")
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected a missing service to be not found, got %v", err)
+	}
+}
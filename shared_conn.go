@@ -0,0 +1,274 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// sharedConn is a single upgraded connection to a pod. Every FwdConn to that
+// pod creates its stream pair on it, and the connection is closed once the
+// last of them is closed.
+type sharedConn struct {
+	key  string
+	conn httpstream.Connection
+
+	// ready is closed once the dial has finished, successfully or not, with
+	// Forwarder.connsMu held. conn and err must only be read after that.
+	ready chan struct{}
+	err   error
+
+	// cancel abandons the dial. It is called once every caller waiting for
+	// the dial has given up.
+	cancel context.CancelFunc
+
+	// refs is guarded by Forwarder.connsMu.
+	refs int
+}
+
+// usable reports whether new streams can still be created on the connection.
+// A connection that is still being dialed is considered usable.
+func (sc *sharedConn) usable() bool {
+	select {
+	case <-sc.ready:
+	default:
+		return true
+	}
+	if sc.err != nil {
+		return false
+	}
+	select {
+	case <-sc.conn.CloseChan():
+		return false
+	default:
+		return true
+	}
+}
+
+func podKey(pod corev1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+// acquire returns a shared connection for the pod, dialing a new one if there
+// is none with room for another stream or the existing ones have been closed.
+// Concurrent callers for the same pod wait on a single dial, which runs on its
+// own so that callers giving up do not fail the others; it is only abandoned
+// once all of them have. Every successful acquire must be paired with a
+// release.
+func (fw *Forwarder) acquire(ctx context.Context, pod corev1.Pod) (*sharedConn, error) {
+	key := podKey(pod)
+
+	fw.connsMu.Lock()
+	var sc *sharedConn
+	for _, c := range fw.conns[key] {
+		if c.usable() && (fw.maxStreams <= 0 || c.refs < fw.maxStreams) {
+			sc = c
+			break
+		}
+	}
+	if sc != nil {
+		sc.refs++
+		fw.connsMu.Unlock()
+		trace.SpanFromContext(ctx).SetAttributes(attrShared.Bool(true))
+	} else {
+		sc = &sharedConn{key: key, refs: 1, ready: make(chan struct{})}
+		fw.conns[key] = append(fw.conns[key], sc)
+		var dialCtx context.Context
+		dialCtx, sc.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		fw.connsMu.Unlock()
+		go fw.dialShared(dialCtx, sc, pod)
+	}
+
+	select {
+	case <-sc.ready:
+	case <-ctx.Done():
+		fw.release(sc)
+		return nil, ctx.Err()
+	}
+	if sc.err != nil {
+		fw.release(sc)
+		return nil, sc.err
+	}
+	return sc, nil
+}
+
+// dialShared dials the connection for sc and makes it ready. If every caller
+// gave up on the dial in the meantime, the connection is closed right away.
+func (fw *Forwarder) dialShared(ctx context.Context, sc *sharedConn, pod corev1.Pod) {
+	defer sc.cancel()
+	conn, err := fw.dial(ctx, pod)
+
+	fw.connsMu.Lock()
+	sc.conn, sc.err = conn, err
+	close(sc.ready)
+	abandoned := sc.refs == 0
+	fw.connsMu.Unlock()
+
+	if err != nil {
+		return
+	}
+	if abandoned {
+		conn.Close()
+		return
+	}
+	go func() {
+		// Forget the connection as soon as it goes away so the next Forward
+		// dials a fresh one instead of failing on a dead one.
+		<-conn.CloseChan()
+		fw.connsMu.Lock()
+		fw.forget(sc)
+		fw.connsMu.Unlock()
+	}()
+}
+
+// release drops a reference to the shared connection, closing it when it was
+// the last one. If it is still being dialed, the dial is abandoned instead.
+func (fw *Forwarder) release(sc *sharedConn) error {
+	fw.connsMu.Lock()
+	sc.refs--
+	last := sc.refs == 0
+	dialing := !isClosedChan(sc.ready)
+	if last {
+		fw.forget(sc)
+	}
+	fw.connsMu.Unlock()
+
+	switch {
+	case !last:
+		return nil
+	case dialing:
+		sc.cancel()
+		return nil
+	case sc.conn == nil:
+		return nil
+	}
+	return sc.conn.Close()
+}
+
+// forget removes the shared connection from fw.conns, if it is still there.
+// fw.connsMu must be held.
+func (fw *Forwarder) forget(sc *sharedConn) {
+	conns := slices.DeleteFunc(fw.conns[sc.key], func(c *sharedConn) bool { return c == sc })
+	if len(conns) == 0 {
+		delete(fw.conns, sc.key)
+		return
+	}
+	fw.conns[sc.key] = conns
+}
+
+// dial performs the HTTP upgrade against the pod's portforward subresource.
+func (fw *Forwarder) dial(ctx context.Context, pod corev1.Pod) (conn httpstream.Connection, err error) {
+	start := time.Now()
+	ctx, span := fw.startSpan(ctx, "k8sport.Dial", pod.Namespace, pod.Name)
+	defer func() {
+		endSpan(span, err)
+		fw.log.DebugContext(ctx, "dialed pod",
+			"namespace", pod.Namespace, "pod", pod.Name, "duration", time.Since(start), "err", err)
+		fw.metrics.DialDone(pod.Namespace, pod.Name, time.Since(start), err)
+	}()
+
+	if fw.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fw.dialTimeout)
+		defer cancel()
+	}
+
+	req := fw.kc.Post().
+		Prefix("api/v1").
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("portforward")
+
+	// The upgrade only watches ctx while connecting, so it is abandoned here
+	// if ctx ends during the handshake, and its connection closed once it is
+	// done.
+	ch := make(chan upgradeResult, 1)
+	go func() {
+		var res upgradeResult
+		res.conn, res.retryAfter, res.err = fw.upgradeConn(ctx, pod, req.URL())
+		ch <- res
+	}()
+
+	var res upgradeResult
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		res.err = ctx.Err()
+	}
+	if res.err != nil {
+		return nil, &upgradeError{
+			err:        fmt.Errorf("error dialing for stream: %w", res.err),
+			retryAfter: res.retryAfter,
+		}
+	}
+	return res.conn, nil
+}
+
+type upgradeResult struct {
+	conn       httpstream.Connection
+	retryAfter time.Duration
+	err        error
+}
+
+// upgradeConn upgrades a request to u with the Forwarder's protocol.
+func (fw *Forwarder) upgradeConn(ctx context.Context, pod corev1.Pod, u *url.URL) (httpstream.Connection, time.Duration, error) {
+	switch fw.upgrade {
+	case UpgradeWebSocket:
+		conn, err := fw.dialWebSocket(ctx, u)
+		return conn, 0, err
+	case UpgradeWebSocketWithFallback:
+		conn, err := fw.dialWebSocket(ctx, u)
+		if err != nil && (httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)) {
+			fw.log.DebugContext(ctx, "falling back to SPDY", "namespace", pod.Namespace, "pod", pod.Name, "err", err)
+			return fw.dialSPDY(ctx, u)
+		}
+		return conn, 0, err
+	}
+	return fw.dialSPDY(ctx, u)
+}
+
+// lockDial serializes upgrades, as the round trippers keep per-request state.
+// It gives up when ctx ends.
+func (fw *Forwarder) lockDial(ctx context.Context) error {
+	select {
+	case fw.dialMu <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (fw *Forwarder) unlockDial() {
+	<-fw.dialMu
+}
+
+// dialSPDY upgrades a request to u to a SPDY connection. It also returns the
+// Retry-After header of a failed upgrade.
+func (fw *Forwarder) dialSPDY(ctx context.Context, u *url.URL) (httpstream.Connection, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating request: %w", err)
+	}
+
+	if err := fw.lockDial(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer fw.unlockDial()
+	rec := &retryAfterRecorder{rt: fw.transport}
+	conn, _, err := spdy.Negotiate(fw.upgrader, &http.Client{Transport: rec}, req, fw.protocols...)
+	return conn, rec.retryAfter, err
+}
@@ -0,0 +1,238 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var (
+	ErrNoReadyPods           = fmt.Errorf("no ready pods")
+	ErrUnsupportedTargetKind = fmt.Errorf("unsupported target kind")
+)
+
+// TargetKind identifies what a Target refers to.
+type TargetKind string
+
+const (
+	KindPod         TargetKind = "pod"
+	KindService     TargetKind = "svc"
+	KindDeployment  TargetKind = "deployment"
+	KindStatefulSet TargetKind = "statefulset"
+	KindReplicaSet  TargetKind = "replicaset"
+	KindDaemonSet   TargetKind = "daemonset"
+	KindSelector    TargetKind = "selector"
+)
+
+// Target refers to a pod, or to a set of pods of which a ready one is chosen
+// each time a connection is forwarded.
+type Target struct {
+	Kind TargetKind
+
+	// Namespace defaults to the Forwarder's namespace if empty.
+	Namespace string
+
+	// Name is the name of the pod, service or workload. It is unused for
+	// KindSelector.
+	Name string
+
+	// Selector is a label selector such as "app=foo,tier!=cache", used with
+	// KindSelector.
+	Selector string
+
+	// Policy chooses among the ready pods. It defaults to PickFirst.
+	Policy PickPolicy
+}
+
+func (t Target) String() string {
+	if t.Kind == KindSelector {
+		return fmt.Sprintf("%s/%s/%s", t.Kind, t.Namespace, t.Selector)
+	}
+	return fmt.Sprintf("%s/%s/%s", t.Kind, t.Namespace, t.Name)
+}
+
+// PickPolicy chooses the pod to forward to from a non-empty list of ready
+// candidates.
+type PickPolicy func(fw *Forwarder, pods []corev1.Pod) corev1.Pod
+
+// PickFirst chooses the first ready pod in the order the apiserver listed them.
+func PickFirst(_ *Forwarder, pods []corev1.Pod) corev1.Pod {
+	return pods[0]
+}
+
+// PickRandom chooses a ready pod at random.
+func PickRandom(_ *Forwarder, pods []corev1.Pod) corev1.Pod {
+	return pods[rand.IntN(len(pods))]
+}
+
+// PickNewest chooses the most recently created ready pod. Service endpoints do
+// not carry a creation time, so for services it behaves like PickFirst.
+func PickNewest(_ *Forwarder, pods []corev1.Pod) corev1.Pod {
+	newest := pods[0]
+	for _, p := range pods[1:] {
+		if newest.CreationTimestamp.Before(&p.CreationTimestamp) {
+			newest = p
+		}
+	}
+	return newest
+}
+
+// PickLeastUsed chooses the ready pod with the fewest open connections from
+// this Forwarder.
+func PickLeastUsed(fw *Forwarder, pods []corev1.Pod) corev1.Pod {
+	least, leastConns := pods[0], fw.ActiveConns(pods[0])
+	for _, p := range pods[1:] {
+		if n := fw.ActiveConns(p); n < leastConns {
+			least, leastConns = p, n
+		}
+	}
+	return least
+}
+
+// ActiveConns returns the number of open connections this Forwarder has to the
+// pod.
+func (fw *Forwarder) ActiveConns(pod corev1.Pod) int {
+	fw.connsMu.Lock()
+	defer fw.connsMu.Unlock()
+	n := 0
+	for _, sc := range fw.conns[podKey(pod)] {
+		n += sc.refs
+	}
+	return n
+}
+
+// ForwardTarget resolves the target to a ready pod and establishes a port
+// forwarding connection to it. For services the port is a service port, for
+// every other kind it is the pod port.
+func (fw *Forwarder) ForwardTarget(ctx context.Context, t Target, port string) (*FwdConn, error) {
+	pod, podPort, err := fw.ResolveTarget(ctx, t, port)
+	if err != nil {
+		return nil, err
+	}
+	return fw.Forward(ctx, pod, podPort)
+}
+
+// ResolveTarget returns the pod that ForwardTarget would forward to, along
+// with the pod port to use.
+func (fw *Forwarder) ResolveTarget(ctx context.Context, t Target, port string) (corev1.Pod, string, error) {
+	if t.Namespace == "" {
+		t.Namespace = fw.namespace
+	}
+	switch t.Kind {
+	case KindPod:
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: t.Namespace,
+				Name:      t.Name,
+			},
+		}
+		return pod, port, nil
+	case KindService:
+		return fw.resolveService(ctx, t, port)
+	case KindSelector:
+		pod, err := fw.pickPod(ctx, t, t.Selector)
+		return pod, port, err
+	}
+
+	selector, err := fw.workloadSelector(ctx, t)
+	if err != nil {
+		return corev1.Pod{}, "", err
+	}
+	pod, err := fw.pickPod(ctx, t, selector)
+	return pod, port, err
+}
+
+// workloadSelector returns the pod label selector of an apps/v1 workload.
+func (fw *Forwarder) workloadSelector(ctx context.Context, t Target) (string, error) {
+	var (
+		obj      runtime.Object
+		resource string
+		selector func() *metav1.LabelSelector
+	)
+	switch t.Kind {
+	case KindDeployment:
+		var d appsv1.Deployment
+		obj, resource, selector = &d, "deployments", func() *metav1.LabelSelector { return d.Spec.Selector }
+	case KindStatefulSet:
+		var s appsv1.StatefulSet
+		obj, resource, selector = &s, "statefulsets", func() *metav1.LabelSelector { return s.Spec.Selector }
+	case KindReplicaSet:
+		var r appsv1.ReplicaSet
+		obj, resource, selector = &r, "replicasets", func() *metav1.LabelSelector { return r.Spec.Selector }
+	case KindDaemonSet:
+		var d appsv1.DaemonSet
+		obj, resource, selector = &d, "daemonsets", func() *metav1.LabelSelector { return d.Spec.Selector }
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedTargetKind, t.Kind)
+	}
+
+	err := fw.kc.Get().
+		Prefix("apis/apps/v1").
+		Namespace(t.Namespace).
+		Resource(resource).
+		Name(t.Name).
+		Do(ctx).
+		Into(obj)
+	if err != nil {
+		return "", fmt.Errorf("error getting %s: %w", t, err)
+	}
+
+	sel, err := metav1.LabelSelectorAsSelector(selector())
+	if err != nil {
+		return "", fmt.Errorf("error parsing selector of %s: %w", t, err)
+	}
+	return sel.String(), nil
+}
+
+// pickPod lists the pods matching the selector and chooses a ready one using
+// the target's policy.
+func (fw *Forwarder) pickPod(ctx context.Context, t Target, selector string) (corev1.Pod, error) {
+	var pods corev1.PodList
+	err := fw.kc.Get().
+		Prefix("api/v1").
+		Namespace(t.Namespace).
+		Resource("pods").
+		Param("labelSelector", selector).
+		Do(ctx).
+		Into(&pods)
+	if err != nil {
+		return corev1.Pod{}, fmt.Errorf("error listing pods for %s: %w", t, err)
+	}
+
+	var ready []corev1.Pod
+	for _, p := range pods.Items {
+		if podReady(p) {
+			ready = append(ready, p)
+		}
+	}
+	if len(ready) == 0 {
+		return corev1.Pod{}, fmt.Errorf("%w: %s", ErrNoReadyPods, t)
+	}
+	return fw.pick(t, ready), nil
+}
+
+func (fw *Forwarder) pick(t Target, pods []corev1.Pod) corev1.Pod {
+	if t.Policy == nil {
+		return PickFirst(fw, pods)
+	}
+	return t.Policy(fw, pods)
+}
+
+// podReady reports whether the pod is running, not being deleted and passing
+// its readiness checks.
+func podReady(p corev1.Pod) bool {
+	if p.Status.Phase != corev1.PodRunning || p.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
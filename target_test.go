@@ -0,0 +1,176 @@
+package k8sport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func TestPickPolicies(t *testing.T) {
+	now := time.Now()
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "old", CreationTimestamp: metav1.NewTime(now.Add(-time.Hour))}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "new", CreationTimestamp: metav1.NewTime(now)}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mid", CreationTimestamp: metav1.NewTime(now.Add(-time.Minute))}},
+	}
+
+	fw := &Forwarder{conns: map[string][]*sharedConn{
+		"ns/old": {{refs: 1}, {refs: 1}},
+		"ns/new": {{refs: 1}},
+	}}
+
+	testCases := []struct {
+		name   string
+		policy PickPolicy
+		want   string
+	}{
+		{name: "first", policy: PickFirst, want: "old"},
+		{name: "newest", policy: PickNewest, want: "new"},
+		{name: "least used", policy: PickLeastUsed, want: "mid"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy(fw, pods).Name; got != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPodReady(t *testing.T) {
+	ready := corev1.Pod{
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	if !podReady(ready) {
+		t.Errorf("Expected running pod with Ready condition to be ready")
+	}
+
+	deleting := *ready.DeepCopy()
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	if podReady(deleting) {
+		t.Errorf("Expected pod being deleted not to be ready")
+	}
+
+	pending := *ready.DeepCopy()
+	pending.Status.Phase = corev1.PodPending
+	if podReady(pending) {
+		t.Errorf("Expected pending pod not to be ready")
+	}
+}
+
+func TestResolveWorkloadTarget(t *testing.T) {
+	selector := &metav1.LabelSelector{
+		MatchLabels:      map[string]string{"app": "web"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"a", "b"}}},
+	}
+	workloads := map[string]any{
+		"deployments":  appsv1.Deployment{TypeMeta: metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"}, Spec: appsv1.DeploymentSpec{Selector: selector}},
+		"statefulsets": appsv1.StatefulSet{TypeMeta: metav1.TypeMeta{Kind: "StatefulSet", APIVersion: "apps/v1"}, Spec: appsv1.StatefulSetSpec{Selector: selector}},
+		"replicasets":  appsv1.ReplicaSet{TypeMeta: metav1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"}, Spec: appsv1.ReplicaSetSpec{Selector: selector}},
+		"daemonsets":   appsv1.DaemonSet{TypeMeta: metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"}, Spec: appsv1.DaemonSetSpec{Selector: selector}},
+	}
+	notReady := readyPod("web-a", "ua", "1")
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+	// Pods are only listed for the selectors built from the workloads and the
+	// selector targets, so that a wrong labelSelector finds no pods.
+	pods := map[string][]corev1.Pod{
+		"app=web,tier in (a,b)": {notReady, readyPod("web-b", "ub", "1")},
+		"app=down":              {notReady},
+	}
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/api/v1/namespaces/ns/pods" {
+			json.NewEncoder(w).Encode(corev1.PodList{
+				TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+				Items:    pods[r.URL.Query().Get("labelSelector")],
+			})
+			return
+		}
+		resource, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/apis/apps/v1/namespaces/ns/"), "/")
+		workload, known := workloads[resource]
+		if !ok || !known || name != "web" {
+			k8sporttest.WriteStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(workload)
+	}))
+	defer srv.Close()
+
+	fw, err := NewForwarder(&rest.Config{Host: srv.URL}, WithNamespace("ns"))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	for _, tt := range []struct {
+		target   Target
+		wantPath string
+		wantPod  string
+		wantErr  error
+	}{
+		{target: Target{Kind: KindDeployment, Name: "web"}, wantPath: "/apis/apps/v1/namespaces/ns/deployments/web", wantPod: "web-b"},
+		{target: Target{Kind: KindStatefulSet, Name: "web"}, wantPath: "/apis/apps/v1/namespaces/ns/statefulsets/web", wantPod: "web-b"},
+		{target: Target{Kind: KindReplicaSet, Name: "web"}, wantPath: "/apis/apps/v1/namespaces/ns/replicasets/web", wantPod: "web-b"},
+		{target: Target{Kind: KindDaemonSet, Name: "web"}, wantPath: "/apis/apps/v1/namespaces/ns/daemonsets/web", wantPod: "web-b"},
+		{target: Target{Kind: KindSelector, Selector: "app=web,tier in (a,b)"}, wantPod: "web-b"},
+		{target: Target{Kind: KindSelector, Selector: "app=down"}, wantErr: ErrNoReadyPods},
+		{target: Target{Kind: "cronjob", Name: "web"}, wantErr: ErrUnsupportedTargetKind},
+	} {
+		t.Run(tt.target.String(), func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+
+			pod, port, err := fw.ResolveTarget(context.Background(), tt.target, "8080")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve target: %v", err)
+			}
+			if pod.Name != tt.wantPod || port != "8080" {
+				t.Errorf("Expected %s:8080, got %s:%s", tt.wantPod, pod.Name, port)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.wantPath != "" && (len(paths) == 0 || paths[0] != tt.wantPath) {
+				t.Errorf("Expected the workload to be fetched from %s, got %v", tt.wantPath, paths)
+			}
+		})
+	}
+
+	_, _, err = fw.ResolveTarget(context.Background(), Target{Kind: KindDeployment, Name: "missing"}, "8080")
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected a missing deployment to be not found, got %v", err)
+	}
+}
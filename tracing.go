@@ -0,0 +1,73 @@
+package k8sport
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans a Forwarder creates.
+const tracerName = "github.com/microcumulus/k8s-portforward-conn"
+
+// Attribute keys set on spans, in addition to the k8s.namespace.name and
+// k8s.pod.name semantic conventions.
+const (
+	attrPort       = attribute.Key("k8sport.port")
+	attrRequestID  = attribute.Key("k8sport.request_id")
+	attrStreamType = attribute.Key("k8sport.stream_type")
+	attrShared     = attribute.Key("k8sport.shared_conn")
+	attrBytesRead  = attribute.Key("k8sport.bytes_read")
+	attrBytesWrite = attribute.Key("k8sport.bytes_written")
+	attrCloseCause = attribute.Key("k8sport.close_reason")
+)
+
+func podAttrs(namespace, pod string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("k8s.namespace.name", namespace),
+		attribute.String("k8s.pod.name", pod),
+	}
+}
+
+// startSpan starts a client span for an operation on the pod.
+func (fw *Forwarder) startSpan(ctx context.Context, name, namespace, pod string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return fw.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(podAttrs(namespace, pod)...),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceConn starts the span covering the lifetime of fc, if the Forwarder was
+// created WithConnSpans. It is ended by Close.
+func (fw *Forwarder) traceConn(ctx context.Context, fc *FwdConn) {
+	if !fw.connSpans {
+		return
+	}
+	_, fc.span = fw.startSpan(ctx, "k8sport.FwdConn", fc.pod.Namespace, fc.pod.Name, attrPort.String(fc.port))
+}
+
+// endConnSpan ends the lifetime span of f with its byte totals and the reason
+// it was closed.
+func (f *FwdConn) endConnSpan(err error) {
+	reason := "closed"
+	if err != nil {
+		reason = err.Error()
+	}
+	f.span.SetAttributes(
+		attrBytesRead.Int64(f.nread.Load()),
+		attrBytesWrite.Int64(f.nwritten.Load()),
+		attrCloseCause.String(reason),
+	)
+	endSpan(f.span, err)
+}
@@ -0,0 +1,129 @@
+package k8sport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func spanAttr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestForwardSpans(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	rec := tracetest.NewSpanRecorder()
+	fw, err := NewForwarder(&rest.Config{Host: srv.URL}, WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+	if _, err := fw.Forward(context.Background(), pod, "80"); err == nil {
+		t.Fatalf("Expected forward to be refused")
+	}
+
+	spans := rec.Ended()
+	if len(spans) != 2 || spans[0].Name() != "k8sport.Dial" || spans[1].Name() != "k8sport.Forward" {
+		t.Fatalf("Expected Dial and Forward spans, got %v", spans)
+	}
+	dial, fwd := spans[0], spans[1]
+	if dial.Parent().SpanID() != fwd.SpanContext().SpanID() {
+		t.Errorf("Expected Dial to be a child of Forward")
+	}
+	if fwd.Status().Code != codes.Error {
+		t.Errorf("Expected Forward span to record the error, got %v", fwd.Status())
+	}
+	if got := spanAttr(fwd, "k8s.pod.name").AsString(); got != "mypod" {
+		t.Errorf("Expected pod attribute mypod, got %q", got)
+	}
+	if got := spanAttr(fwd, attrPort).AsString(); got != "80" {
+		t.Errorf("Expected port attribute 80, got %q", got)
+	}
+}
+
+func TestConnSpan(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	fc, remote := newPipeFwdConn(t)
+	fc.fw = newTestForwarder(t, WithConnSpans(), WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))))
+	fc.sc = newStubSharedConn(fc.pod)
+	fc.fw.traceConn(context.Background(), fc)
+
+	go remote.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := fc.Read(buf); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	go remote.Read(make([]byte, 3))
+	if _, err := fc.Write([]byte("hey")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if len(rec.Ended()) != 0 {
+		t.Fatalf("Expected the span to last until Close")
+	}
+	fc.Close()
+
+	spans := rec.Ended()
+	if len(spans) != 1 || spans[0].Name() != "k8sport.FwdConn" {
+		t.Fatalf("Expected a FwdConn span, got %v", spans)
+	}
+	if got := spanAttr(spans[0], attrBytesRead).AsInt64(); got != 5 {
+		t.Errorf("Expected 5 bytes read, got %d", got)
+	}
+	if got := spanAttr(spans[0], attrBytesWrite).AsInt64(); got != 3 {
+		t.Errorf("Expected 3 bytes written, got %d", got)
+	}
+}
+
+func TestConnSpanKubeletError(t *testing.T) {
+	srv := k8sporttest.NewServer()
+	defer srv.Close()
+	srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+
+	rec := tracetest.NewSpanRecorder()
+	fw, err := NewForwarder(srv.Config(), WithConnSpans(), WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))))
+	if err != nil {
+		t.Fatalf("Failed to create Forwarder: %v", err)
+	}
+
+	// Nothing listens on 81, so the error arrives right after the forward.
+	fc, err := fw.Forward(context.Background(), corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}, "81")
+	if err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	<-fc.Done()
+	fc.Close()
+
+	var conn sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.Name() == "k8sport.FwdConn" {
+			conn = s
+		}
+	}
+	if conn == nil {
+		t.Fatalf("Expected a FwdConn span")
+	}
+	if len(conn.Events()) == 0 || conn.Status().Code != codes.Error {
+		t.Errorf("Expected the FwdConn span to record the kubelet error, got events %v status %v", conn.Events(), conn.Status())
+	}
+}
@@ -0,0 +1,32 @@
+package k8sport
+
+import (
+	"net/http"
+)
+
+// HTTPTransport returns an http.Transport that dials a new FwdConn for every
+// connection it opens, routing each request by its URL host as DialContext
+// does, e.g. http://web.default.svc/ or http://mypod.default.pod.cluster.local:8080/.
+// Connections are pooled by the transport as usual and its settings, such as
+// MaxIdleConnsPerHost and IdleConnTimeout, may be changed before use. Since
+// every FwdConn to a pod shares one upgraded connection, pooled connections
+// are cheap.
+func (fw *Forwarder) HTTPTransport() *http.Transport {
+	d := Dialer{Forwarder: fw}
+	return d.HTTPTransport()
+}
+
+// HTTPClient returns an http.Client using the Forwarder's HTTPTransport.
+func (fw *Forwarder) HTTPClient() *http.Client {
+	return &http.Client{Transport: fw.HTTPTransport()}
+}
+
+// HTTPTransport returns an http.Transport that dials through the Dialer,
+// starting from the settings of http.DefaultTransport. Requests are never sent
+// through an HTTP proxy.
+func (d *Dialer) HTTPTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
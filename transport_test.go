@@ -0,0 +1,116 @@
+package k8sport
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	const clients = 4
+
+	var (
+		conns, active atomic.Int32
+		arrivedMu     sync.Mutex
+		arrived       int
+		ready         = make(chan struct{})
+	)
+	// serve answers keep-alive requests with the name of the pod, holding the
+	// first request on every connection until each client has sent one, so
+	// that the transport has to open a connection per client.
+	serve := func(c *k8sporttest.Conn) {
+		conns.Add(1)
+		active.Add(1)
+		defer active.Add(-1)
+
+		br := bufio.NewReader(c)
+		for first := true; ; first = false {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, req.Body)
+			if first && c.Pod == "mypod" {
+				arrivedMu.Lock()
+				if arrived++; arrived == clients {
+					close(ready)
+				}
+				arrivedMu.Unlock()
+				<-ready
+			}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{},
+				ContentLength: int64(len(c.Pod)),
+				Body:          io.NopCloser(strings.NewReader(c.Pod)),
+			}
+			if err := resp.Write(c); err != nil {
+				return
+			}
+		}
+	}
+
+	srv, fw := newFakeServer(t)
+	srv.Handle("ns", "mypod", "80", serve)
+	srv.Handle("ns", "otherpod", "80", serve)
+
+	tr := fw.HTTPTransport()
+	tr.MaxIdleConnsPerHost = clients
+	cli := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	get := func(host string) (string, error) {
+		res, err := cli.Get("http://" + host + "/")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return string(b), err
+	}
+
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The second request reuses the connection of the first.
+			for range 2 {
+				if body, err := get("mypod.ns.pod.cluster.local"); err != nil || body != "mypod" {
+					t.Errorf("Expected response from mypod, got %q (%v)", body, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := conns.Load(); n != clients {
+		t.Errorf("Expected a stream pair per transport connection, got %d for %d clients", n, clients)
+	}
+	if n := srv.Upgrades(); n != 1 {
+		t.Errorf("Expected the transport's connections to share one upgrade, got %d", n)
+	}
+
+	if body, err := get("otherpod.ns.pod.cluster.local"); err != nil || body != "otherpod" {
+		t.Errorf("Expected the request to be routed to otherpod, got %q (%v)", body, err)
+	}
+	if n := srv.Upgrades(); n != 2 {
+		t.Errorf("Expected another upgrade for another pod, got %d", n)
+	}
+
+	tr.CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for active.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected CloseIdleConnections to close the forwarded connections, %d still open", active.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
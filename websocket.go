@@ -0,0 +1,76 @@
+package k8sport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	apispdy "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	constants "k8s.io/apimachinery/pkg/util/portforward"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/websocket"
+)
+
+// UpgradeProtocol selects how a Forwarder upgrades its connections to pods.
+type UpgradeProtocol int
+
+const (
+	// UpgradeSPDY upgrades connections with SPDY, which every apiserver
+	// supports but which many proxies and load balancers do not pass through.
+	UpgradeSPDY UpgradeProtocol = iota
+	// UpgradeWebSocket upgrades connections with WebSockets and tunnels the
+	// SPDY streams over them. It needs an apiserver with the
+	// PortForwardWebsockets feature, which is enabled by default since
+	// Kubernetes 1.31.
+	UpgradeWebSocket
+	// UpgradeWebSocketWithFallback tries WebSockets first and falls back to
+	// SPDY if the apiserver or a proxy in between rejects the upgrade.
+	UpgradeWebSocketWithFallback
+)
+
+// WithUpgradeProtocol selects how connections to pods are upgraded. It
+// defaults to UpgradeSPDY. The WebSocket protocols are set up from the
+// rest.Config, so NewForwarder needs one for them even if WithRoundTripper is
+// given.
+func WithUpgradeProtocol(p UpgradeProtocol) Option {
+	return func(fw *Forwarder) {
+		fw.upgrade = p
+	}
+}
+
+// dialWebSocket upgrades a request to u to a WebSocket connection and runs
+// SPDY over it, as portforward.NewSPDYOverWebsocketDialer does, but bound to
+// ctx.
+func (fw *Forwarder) dialWebSocket(ctx context.Context, u *url.URL) (httpstream.Connection, error) {
+	// WebSocket upgrades must use GET, see RFC 6455 section 4.1.
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	protocols := make([]string, 0, len(fw.protocols))
+	for _, p := range fw.protocols {
+		protocols = append(protocols, constants.WebsocketsSPDYTunnelingPrefix+p)
+	}
+
+	// Like the SPDY one, the WebSocket round tripper holds on to the
+	// connection it upgraded last.
+	if err := fw.lockDial(ctx); err != nil {
+		return nil, err
+	}
+	ws, err := websocket.Negotiate(fw.wsTransport, fw.wsHolder, req, protocols...)
+	fw.unlockDial()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel := portforward.NewTunnelingConnection("client", ws)
+	conn, err := apispdy.NewClientConnectionWithPings(tunnel, portforward.PingPeriod)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,80 @@
+package k8sport
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/microcumulus/k8s-portforward-conn/k8sporttest"
+)
+
+func TestWebSocketUpgrade(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		protocol     UpgradeProtocol
+		reject       bool
+		wantErr      bool
+		wantWS       int
+		wantUpgrades int
+	}{
+		{name: "websocket", protocol: UpgradeWebSocket, wantWS: 1, wantUpgrades: 1},
+		{name: "websocket rejected", protocol: UpgradeWebSocket, reject: true, wantErr: true},
+		{name: "fallback unused", protocol: UpgradeWebSocketWithFallback, wantWS: 1, wantUpgrades: 1},
+		{name: "fallback to spdy", protocol: UpgradeWebSocketWithFallback, reject: true, wantUpgrades: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := k8sporttest.NewServer()
+			defer srv.Close()
+			srv.Handle("ns", "mypod", "80", k8sporttest.Echo)
+			if tt.reject {
+				srv.RejectWebSockets()
+			}
+
+			fw, err := NewForwarder(srv.Config(), WithUpgradeProtocol(tt.protocol))
+			if err != nil {
+				t.Fatalf("Failed to create Forwarder: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "mypod"}}
+			fc, err := fw.Forward(ctx, pod, "80")
+			if tt.wantErr {
+				if err == nil {
+					fc.Close()
+					t.Fatalf("Expected the rejected upgrade to fail the forward")
+				}
+				if srv.Upgrades() != 0 {
+					t.Errorf("Expected no upgrades, got %d", srv.Upgrades())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to forward: %v", err)
+			}
+			defer fc.Close()
+
+			if _, err := fc.Write([]byte("hello")); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			if err := fc.CloseWrite(); err != nil {
+				t.Fatalf("Failed to close writing side: %v", err)
+			}
+			b, err := io.ReadAll(fc)
+			if err != nil || string(b) != "hello" {
+				t.Errorf("Expected echo of hello, got %q (%v)", b, err)
+			}
+
+			if n := srv.Upgrades(); n != tt.wantUpgrades {
+				t.Errorf("Expected %d upgrades, got %d", tt.wantUpgrades, n)
+			}
+			if n := srv.WebSocketUpgrades(); n != tt.wantWS {
+				t.Errorf("Expected %d WebSocket upgrades, got %d", tt.wantWS, n)
+			}
+		})
+	}
+}